@@ -1,116 +1,207 @@
 package lsystem
 
 import (
+	"context"
+	"fmt"
 	"github.com/go-echarts/go-echarts/v2/charts"
 	"github.com/go-echarts/go-echarts/v2/opts"
 	"io"
-	"log"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 )
 
+// AnalysisOptions configures AnalyseProductionRates. Zero fields take the
+// defaults of DefaultAnalysisOptions.
+type AnalysisOptions struct {
+	// Runs is the number of independent derivations, seeded Seed, Seed+1, ...
+	Runs int
+	Seed uint64
+	// Iterations is the number of generations derived before sampling starts,
+	// Samples the number of generations sampled after that in every run.
+	Iterations int
+	Samples    int
+	// MaxTokens ends a run once a generation grows larger.
+	MaxTokens   int
+	Percentiles []float64
+}
+
+func DefaultAnalysisOptions() AnalysisOptions {
+	return AnalysisOptions{
+		Runs:        1,
+		Samples:     80,
+		MaxTokens:   1 << 20,
+		Percentiles: []float64{5, 25, 50, 75, 95},
+	}
+}
+
+func (o AnalysisOptions) withDefaults() AnalysisOptions {
+	defaults := DefaultAnalysisOptions()
+	if o.Runs <= 0 {
+		o.Runs = defaults.Runs
+	}
+	if o.Samples <= 0 {
+		o.Samples = defaults.Samples
+	}
+	if o.MaxTokens <= 0 {
+		o.MaxTokens = defaults.MaxTokens
+	}
+	if o.Percentiles == nil {
+		o.Percentiles = defaults.Percentiles
+	}
+	return o
+}
+
+// GrowthStats summarises the growth ratios, the length of a generation divided
+// by the length of the one before, of a ProductionRate.
+type GrowthStats struct {
+	Samples  int     `json:"samples"`
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	// Percentiles holds the values of AnalysisOptions.Percentiles, in order.
+	Percentiles []Percentile `json:"percentiles"`
+}
+
+type Percentile struct {
+	Rank  float64 `json:"rank"`
+	Value float64 `json:"value"`
+}
+
 // AnalyseProductionRates analyses the production rate of each production rule
 // by creating a new LSystem for each rule containing only its own rules
 // and itself as axiom. Then it iterates the LSystem for a given number of
-// iterations and analyzing the distribution of the produced tokens.
-func (l *LSystem) AnalyseProductionRates() map[Token]ProductionRate {
-	tokensProduced := make(map[Token]ProductionRate)
-	const iterations = 1
-
-	fnCalcAvgGrowth := func(rate ProductionRate) {
-		totalSum := 0
-		avgGrowingRate := 0.0
-		for _, rate := range rate.Rates {
-			totalSum += int(rate)
-		}
+// iterations and analyzing the distribution of the produced tokens. The whole
+// system is analysed from its axiom under the key "LSystem"; l itself is left
+// untouched. Runs stop at opts.MaxTokens and at the memory limit of l.
+func (l *LSystem) AnalyseProductionRates(opts AnalysisOptions) map[Token]ProductionRate {
+	rates, _ := l.AnalyseProductionRatesContext(context.Background(), opts)
+	return rates
+}
 
-		for idx, rate := range rate.Rates {
-			avgGrowingRate += float64(idx) * float64(rate) / float64(totalSum)
-		}
+// AnalyseProductionRatesContext is AnalyseProductionRates returning the error
+// of ctx once it is done.
+func (l *LSystem) AnalyseProductionRatesContext(ctx context.Context, opts AnalysisOptions) (map[Token]ProductionRate, error) {
+	opts = opts.withDefaults()
+	productionRates := make(map[Token]ProductionRate, len(l.Rules)+1)
 
-		log.Println("Production Rates (Avg growth " + strconv.FormatFloat(avgGrowingRate/1000, 'f', 4, 64) + ")")
+	var err error
+	for token, rule := range l.Rules {
+		r := rule
+		productionRates[token], err = analyse(ctx, token, &r, opts, func(seed uint64) (*LSystem, error) {
+			return NewValidatedLSystem(token, map[Token]ProductionRule{token: r}, l.Variables, l.Constants, false,
+				WithSeed(seed), WithMaxTokens(opts.MaxTokens), WithMaxMemory(l.maxBytes), WithWorkers(1))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	productionRates["LSystem"], err = analyse(ctx, "LSystem", l, opts, func(seed uint64) (*LSystem, error) {
+		return NewValidatedLSystem(l.Axiom, l.Rules, l.Variables, l.Constants, false,
+			WithSeed(seed), WithMaxTokens(opts.MaxTokens), WithMaxMemory(l.maxBytes), WithContextIgnore(l.contextIgnore...))
+	})
+	if err != nil {
+		return nil, err
 	}
+	return productionRates, nil
+}
 
-	fnSampleLsystem := func(token Token, lsystem *LSystem, iters, samples int) {
-		for i := 0; i < iters; i++ {
-			lsystem.Reset()
-			prevLen := 0
-			for j := 0; j < samples; j++ {
-				tokens := lsystem.IterateOnce()
-				length := len(tokens)
-				if prevLen == 0 {
-					prevLen = length
-					continue
-				}
-				diff := int(math.Round(float64(length) / float64(prevLen) * 1000))
-				if diff >= len(tokensProduced[token].Rates) {
-					replacement := make([]float32, diff*2)
-					copy(replacement, tokensProduced[token].Rates)
-					tokensProduced[token] = ProductionRate{
-						Token: token,
-						Rates: replacement,
-						Rule:  tokensProduced[token].Rule,
-					}
+// analyse samples the growth ratios of the L-systems made by create. Runs
+// stopped by a limit contribute the ratios sampled so far, ctx being done or
+// create failing stops the analysis.
+func analyse(ctx context.Context, token Token, rule fmt.Stringer, opts AnalysisOptions, create func(seed uint64) (*LSystem, error)) (ProductionRate, error) {
+	rate := ProductionRate{Token: token, Rates: make([]float32, 1024), Rule: rule}
+	for run := 0; run < opts.Runs; run++ {
+		ls, err := create(opts.Seed + uint64(run))
+		if err != nil {
+			return rate, err
+		}
+		if ls.IterateContext(ctx, opts.Iterations) != nil {
+			if err := ctx.Err(); err != nil {
+				return rate, err
+			}
+			continue
+		}
+		prevLen := ls.Len()
+		for j := 0; j < opts.Samples; j++ {
+			if ls.IterateContext(ctx, 1) != nil {
+				if err := ctx.Err(); err != nil {
+					return rate, err
 				}
+				break
+			}
+			length := ls.Len()
+			if prevLen == 0 {
 				prevLen = length
-				tokensProduced[token].Rates[diff]++
+				continue
 			}
+			ratio := float64(length) / float64(prevLen)
+			rate.Ratios = append(rate.Ratios, ratio)
 
-			fnCalcAvgGrowth(tokensProduced[token])
-			delete(tokensProduced, token)
+			// the histogram has a bucket per thousandth of the ratio
+			bucket := int(math.Round(ratio * 1000))
+			if bucket >= len(rate.Rates) {
+				replacement := make([]float32, bucket*2)
+				copy(replacement, rate.Rates)
+				rate.Rates = replacement
+			}
+			rate.Rates[bucket]++
+			prevLen = length
 		}
 	}
-
-	//for token, rule := range l.Rules {
-	//	r := rule
-	//	tokensProduced[token] = ProductionRate{
-	//		Token: token,
-	//		Rates: make([]float32, 1024),
-	//		Rule:  &r,
-	//	}
-	//	lsystem := NewLSystem(token, map[Token]ProductionRule{token: r}, l.Variables, l.Constants, false)
-	//	fnSampleLsystem(token, lsystem, iterations, 10)
-	//}
-
-	tokensProduced["LSystem"] = ProductionRate{
-		Token: "LSystem",
-		Rates: make([]float32, 1024),
-		Rule:  l,
-	}
-	fnSampleLsystem("LSystem", l, iterations, 80)
-
-	return tokensProduced
+	rate.Stats = growthStats(rate.Ratios, opts.Percentiles)
+	return rate, nil
 }
 
-type httpHandler func(w http.ResponseWriter, r *http.Request)
+func growthStats(ratios []float64, percentiles []float64) GrowthStats {
+	stats := GrowthStats{Samples: len(ratios)}
+	if len(ratios) == 0 {
+		return stats
+	}
+	sorted := append([]float64(nil), ratios...)
+	sort.Float64s(sorted)
+	stats.Min, stats.Max = sorted[0], sorted[len(sorted)-1]
 
-func (l *LSystem) generateChartHandlers() map[Token]httpHandler {
-	productionRates := l.AnalyseProductionRates()
-	handlers := make(map[Token]httpHandler)
-	for _, rate := range productionRates {
-		r := rate
-		handlers[rate.Token] = func(w http.ResponseWriter, _ *http.Request) {
-			if err := r.RenderChart(w); err != nil {
-				panic(err)
-			}
+	for _, r := range sorted {
+		stats.Mean += r
+	}
+	stats.Mean /= float64(len(sorted))
+	if len(sorted) > 1 {
+		for _, r := range sorted {
+			stats.Variance += (r - stats.Mean) * (r - stats.Mean)
 		}
+		stats.Variance /= float64(len(sorted) - 1)
 	}
-	return handlers
-}
-
-func (l *LSystem) HandleStatisticsServer(w http.ResponseWriter, _ *http.Request) {
-	productionRates := l.AnalyseProductionRates()
 
-	for _, rate := range productionRates {
-		if err := rate.RenderChart(w); err != nil {
-			panic(err)
+	// linear interpolation between the closest ranks
+	for _, p := range percentiles {
+		pos := p / 100 * float64(len(sorted)-1)
+		pos = max(0, min(pos, float64(len(sorted)-1)))
+		lower := int(pos)
+		value := sorted[lower]
+		if lower+1 < len(sorted) {
+			value += (pos - float64(lower)) * (sorted[lower+1] - sorted[lower])
 		}
-
+		stats.Percentiles = append(stats.Percentiles, Percentile{Rank: p, Value: value})
 	}
+	return stats
+}
+
+// HandleStatisticsServer returns the handler of a Server for l, which charts
+// every rule at /charts. It used to be a handler function itself, it now has
+// to be mounted, as in http.Handle("/", l.HandleStatisticsServer()). Build it
+// once: the analysis done for its first request is reused by all others.
+func (l *LSystem) HandleStatisticsServer() http.Handler {
+	return NewServer(l, AnalysisOptions{}).Handler()
 }
 
 func (pr *ProductionRate) RenderChart(w io.Writer) error {
+	return pr.chart().Render(w)
+}
+
+func (pr *ProductionRate) chart() *charts.Bar {
 	// create a new bar instance
 	bar := charts.NewBar()
 	// set some global options like Title/Legend/ToolTip or anything else
@@ -147,14 +238,39 @@ func (pr *ProductionRate) RenderChart(w io.Writer) error {
 	// Put data into instance
 	bar.SetXAxis(labelsUntilLast).
 		AddSeries(title, barItems[0:lastNonZero+1])
-	return bar.Render(w)
+	return bar
+}
+
+// alternativesChart compares the declared weights of the alternatives with
+// how often they were chosen and how often they fired.
+func alternativesChart(alternatives []AlternativeReport) *charts.Bar {
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{Title: "Rule Firing", Subtitle: "Declared weights against the choices made"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+	)
+	labels := make([]string, len(alternatives))
+	weights := make([]opts.BarData, len(alternatives))
+	empirical := make([]opts.BarData, len(alternatives))
+	effective := make([]opts.BarData, len(alternatives))
+	for i, a := range alternatives {
+		labels[i] = string(a.Token) + " #" + strconv.Itoa(a.Alternative)
+		weights[i] = opts.BarData{Value: a.Weight}
+		empirical[i] = opts.BarData{Value: a.Empirical}
+		effective[i] = opts.BarData{Value: a.Effective}
+	}
+	bar.SetXAxis(labels).
+		AddSeries("weight", weights).
+		AddSeries("chosen", empirical).
+		AddSeries("fired", effective)
+	return bar
 }
 
 func (l *LSystem) Serve() error {
-	for token, handler := range l.generateChartHandlers() {
+	return l.ListenAndServe(":8081")
+}
 
-		log.Println("Registering handler for token", token)
-		http.HandleFunc("/"+string(token), handler)
-	}
-	return http.ListenAndServe(":8081", nil)
+// ListenAndServe serves the production rate analysis on addr, see Server.
+func (l *LSystem) ListenAndServe(addr string) error {
+	return NewServer(l, AnalysisOptions{}).ListenAndServe(context.Background(), addr)
 }
@@ -1,19 +1,91 @@
 package lsystem
 
-type TokenStateId uint8
+import (
+	"encoding/binary"
+	"errors"
+)
 
-func (bt TokenStateId) TokenId() uint8 {
-	return uint8(bt & 0x7F)
+// TokenStateId identifies a token or a state of a counter variable. The top
+// bit marks counter states, the remaining bits index the LSystem tables.
+type TokenStateId uint32
+
+const (
+	paramFlag  = TokenStateId(1) << 31
+	MaxTokenId = uint32(paramFlag - 1)
+)
+
+var ErrIdWidth = errors.New("token id does not fit the id width")
+
+func (bt TokenStateId) TokenId() uint32 {
+	return uint32(bt &^ paramFlag)
 }
 
 func (bt TokenStateId) HasParam() bool {
-	return bt&0x80 != 0
+	return bt&paramFlag != 0
 }
 
-func NewTokenStateId(tokenId uint8, hasParam bool) TokenStateId {
+func NewTokenStateId(tokenId uint32, hasParam bool) TokenStateId {
+	id := TokenStateId(tokenId)
 	if hasParam {
-		tokenId |= uint8(0x80)
+		id |= paramFlag
+	}
+
+	return id
+}
+
+// idWidth returns the smallest of 8, 16 or 32 bits able to hold tokenCount
+// ids together with the counter flag.
+func idWidth(tokenCount int) int {
+	switch {
+	case tokenCount <= 1<<7:
+		return 8
+	case tokenCount <= 1<<15:
+		return 16
+	default:
+		return 32
+	}
+}
+
+// AppendPackedIds appends ids to dst using width bits per id, moving the
+// counter flag to the top bit of the narrower encoding.
+func AppendPackedIds(dst []byte, ids []TokenStateId, width int) ([]byte, error) {
+	limit := uint32(1)<<(width-1) - 1
+	for _, id := range ids {
+		tokenId := id.TokenId()
+		if tokenId > limit {
+			return dst, ErrIdWidth
+		}
+		if id.HasParam() {
+			tokenId |= limit + 1
+		}
+		switch width {
+		case 8:
+			dst = append(dst, uint8(tokenId))
+		case 16:
+			dst = binary.LittleEndian.AppendUint16(dst, uint16(tokenId))
+		default:
+			dst = binary.LittleEndian.AppendUint32(dst, tokenId)
+		}
 	}
+	return dst, nil
+}
 
-	return TokenStateId(tokenId)
+// UnpackIds decodes ids written by AppendPackedIds with the same width.
+func UnpackIds(src []byte, width int) []TokenStateId {
+	flag := uint32(1) << (width - 1)
+	ids := make([]TokenStateId, 0, len(src)*8/width)
+	for len(src) >= width/8 {
+		var tokenId uint32
+		switch width {
+		case 8:
+			tokenId = uint32(src[0])
+		case 16:
+			tokenId = uint32(binary.LittleEndian.Uint16(src))
+		default:
+			tokenId = binary.LittleEndian.Uint32(src)
+		}
+		src = src[width/8:]
+		ids = append(ids, NewTokenStateId(tokenId&^flag, tokenId&flag != 0))
+	}
+	return ids
 }
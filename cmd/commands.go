@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/viktordanov/lsystem"
+	"github.com/viktordanov/lsystem/turtle"
+	"github.com/viktordanov/lsystem/voxel"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// create opens path for writing, or stdout when path is empty or "-".
+func create(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+func runCommand(args []string) error {
+	g := newGrammarFlags("run")
+	out := g.fs.String("o", "", "output file (default stdout)")
+	resume := g.fs.String("resume", "", "continue from this snapshot instead of the axiom")
+	checkpoint := g.fs.String("checkpoint", "", "save the last generation to this snapshot file")
+	if err := g.parse(args); err != nil {
+		return err
+	}
+	ls, file, err := g.load()
+	if err != nil {
+		return err
+	}
+	if *resume != "" {
+		if err := restore(ls, *resume); err != nil {
+			return err
+		}
+	}
+	stop, err := g.profile()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	w, err := create(*out)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	first := true
+	write := func(t TokenStateId, args []float64) bool {
+		if !first {
+			bw.WriteByte(' ')
+		}
+		first = false
+		bw.WriteString(Module{Token: ls.BytesToken[t.TokenId()], Args: args}.String())
+		return true
+	}
+	// streaming keeps memory bounded, contextual grammars need whole generations
+	ctx, cancel := g.context()
+	defer cancel()
+	err = ErrContextual
+	if *resume == "" && *checkpoint == "" {
+		err = ls.ExpandContext(ctx, file.Iterations, write)
+	}
+	if errors.Is(err, ErrContextual) {
+		if err = ls.IterateContext(ctx, max(0, file.Iterations-ls.Generation())); err == nil {
+			ls.Walk(write)
+		}
+	}
+	// a run stopped by a limit still checkpoints its last complete generation
+	if *checkpoint != "" {
+		if saveErr := save(ls, *checkpoint); err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	bw.WriteByte('\n')
+	if err := bw.Flush(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func restore(ls *LSystem, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snapshot, err := ReadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return ls.Restore(snapshot)
+}
+
+func save(ls *LSystem, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := ls.Snapshot().WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func statsCommand(args []string) error {
+	g := newGrammarFlags("stats")
+	html := g.fs.String("html", "", "write growth charts to this HTML file instead")
+	runs := g.fs.Int("runs", 1, "seeded runs charted (html) or analysed (-rates)")
+	samples := g.fs.Int("samples", DefaultAnalysisOptions().Samples, "generations sampled per run (-rates)")
+	format := g.fs.String("format", "text", "output format: text, json or csv")
+	rates := g.fs.Bool("rates", false, "include the production rate analysis (json, csv)")
+	if err := g.parse(args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	ls, file, err := g.load()
+	if err != nil {
+		return err
+	}
+	opts := g.analysisOptions(file, *runs)
+	opts.Samples = *samples
+	if *html != "" {
+		return growthCharts(ls, file, *html, opts)
+	}
+	stop, err := g.profile()
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	ctx, cancel := g.context()
+	defer cancel()
+	if *format != "text" {
+		report, err := ls.Report(ctx, file.Iterations)
+		if err != nil {
+			return err
+		}
+		if *rates {
+			rates, err := ls.AnalyseProductionRatesContext(ctx, opts)
+			if err != nil {
+				return err
+			}
+			report.Rates = RateReports(rates)
+		}
+		if *format == "json" {
+			return report.WriteJSON(os.Stdout)
+		}
+		return report.WriteCSV(os.Stdout)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintln(w, "generation\ttokens\tgrowth")
+	previous := ls.Len()
+	fmt.Fprintf(w, "0\t%d\t-\n", previous)
+	for i := 1; i <= file.Iterations; i++ {
+		if err := ls.IterateContext(ctx, 1); err != nil {
+			w.Flush()
+			return err
+		}
+		length := ls.Len()
+		fmt.Fprintf(w, "%d\t%d\t%s\n", i, length, strconv.FormatFloat(float64(length)/float64(previous), 'f', 4, 64))
+		previous = max(length, 1)
+	}
+	return w.Flush()
+}
+
+// analysisOptions returns the options for runs runs, seeded from the grammar's
+// seed on and stopping at -max-tokens.
+func (g *grammarFlags) analysisOptions(file *Grammar, runs int) AnalysisOptions {
+	opts := AnalysisOptions{Runs: runs, MaxTokens: g.maxTokens}
+	if file.Seed != nil {
+		opts.Seed = *file.Seed
+	}
+	return opts
+}
+
+// growthCharts writes the growth of the runs of opts as a standalone HTML
+// page.
+func growthCharts(ls *LSystem, file *Grammar, path string, opts AnalysisOptions) error {
+	w, err := create(path)
+	if err != nil {
+		return err
+	}
+	if err := ls.AnalyseGrowth(file.Iterations, opts).Render(w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func serveCommand(args []string) error {
+	g := newGrammarFlags("serve")
+	addr := g.fs.String("addr", ":8081", "address to listen on")
+	opts := DefaultAnalysisOptions()
+	g.fs.IntVar(&opts.Runs, "runs", opts.Runs, "independent runs per analysis")
+	g.fs.IntVar(&opts.Samples, "samples", opts.Samples, "generations sampled per run")
+	g.fs.IntVar(&opts.Iterations, "generations", opts.Iterations, "generations derived before sampling")
+	if err := g.parse(args); err != nil {
+		return err
+	}
+	ls, _, err := g.load()
+	if err != nil {
+		return err
+	}
+	// interrupting shuts the server down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Fprintf(os.Stderr, "serving /stats and /charts on %s\n", *addr)
+	return NewServer(ls, opts).ListenAndServe(ctx, *addr)
+}
+
+func renderCommand(args []string) error {
+	g := newGrammarFlags("render")
+	out := g.fs.String("o", "", "output file (default stdout)")
+	format := g.fs.String("format", "svg", "output format: svg, vox, json or csv")
+	cfg := turtle.DefaultConfig()
+	g.fs.Float64Var(&cfg.Angle, "angle", cfg.Angle, "turn angle in degrees (svg)")
+	g.fs.Float64Var(&cfg.Step, "step", cfg.Step, "step length (svg)")
+	if err := g.parse(args); err != nil {
+		return err
+	}
+	if *format != "svg" && *format != "vox" && *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	ls, file, err := g.load()
+	if err != nil {
+		return err
+	}
+	hint := func(name string, value *float64) {
+		if v, ok := file.Hint(name); ok && !g.set(name) {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				*value = parsed
+			}
+		}
+	}
+	hint("angle", &cfg.Angle)
+	hint("step", &cfg.Step)
+	ctx, cancel := g.context()
+	defer cancel()
+	if err := ls.IterateUntilContext(ctx, file.Iterations); err != nil {
+		return err
+	}
+
+	w, err := create(*out)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "svg":
+		err = turtle.RenderSVG(w, ls, cfg)
+	case "vox":
+		err = voxel.WriteVOX(w, voxel.Build(ls, voxel.DefaultConfig()), nil)
+	case "json":
+		err = voxel.WriteJSON(w, voxel.Build(ls, voxel.DefaultConfig()))
+	case "csv":
+		err = voxel.WriteCSV(w, voxel.Build(ls, voxel.DefaultConfig()))
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// lintCommand parses the grammar leniently and prints every diagnostic,
+// failing when there are any.
+func lintCommand(args []string) error {
+	g := newGrammarFlags("lint")
+	if err := g.parse(args); err != nil {
+		return err
+	}
+	file, err := g.readFile()
+	if err != nil {
+		return err
+	}
+	if warnings := file.Lint(); len(warnings) > 0 {
+		return warnings
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	. "github.com/viktordanov/lsystem"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+var errNoGrammar = errors.New("no grammar given, use -grammar")
+
+type grammarFlags struct {
+	fs         *flag.FlagSet
+	grammar    string
+	axiom      string
+	iterations int
+	seed       uint64
+	presample  bool
+	threads    int
+	maxTokens  int
+	maxMemory  int
+	timeout    time.Duration
+	cpuprofile string
+}
+
+func newGrammarFlags(name string) *grammarFlags {
+	g := &grammarFlags{fs: flag.NewFlagSet(name, flag.ContinueOnError)}
+	g.fs.StringVar(&g.grammar, "grammar", "", "grammar file (.lsys)")
+	g.fs.StringVar(&g.axiom, "axiom", "", "axiom, overrides the grammar's")
+	g.fs.IntVar(&g.iterations, "n", 0, "number of iterations, overrides the grammar's")
+	g.fs.Uint64Var(&g.seed, "seed", 0, "random seed, overrides the grammar's (default random)")
+	g.fs.BoolVar(&g.presample, "presample", false, "pre-sample rule weights")
+	g.fs.IntVar(&g.threads, "threads", 0, "number of worker goroutines (default GOMAXPROCS)")
+	g.fs.IntVar(&g.maxTokens, "max-tokens", 0, "abort when a generation holds more tokens (default unlimited)")
+	g.fs.IntVar(&g.maxMemory, "max-memory", 0, "abort when the buffers hold more bytes (default unlimited)")
+	g.fs.DurationVar(&g.timeout, "timeout", 0, "abort after this long (default never)")
+	g.fs.StringVar(&g.cpuprofile, "cpuprofile", "", "write cpu profile to file")
+	return g
+}
+
+func (g *grammarFlags) parse(args []string) error {
+	if err := g.fs.Parse(args); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (g *grammarFlags) set(name string) bool {
+	set := false
+	g.fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func (g *grammarFlags) readFile() (*Grammar, error) {
+	if g.grammar == "" {
+		return nil, errNoGrammar
+	}
+	f, err := os.Open(g.grammar)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	grammar, err := LoadGrammar(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", g.grammar, err)
+	}
+	if g.axiom != "" {
+		grammar.Axiom = Token(g.axiom)
+	}
+	if g.set("n") {
+		grammar.Iterations = g.iterations
+	}
+	if g.set("seed") {
+		grammar.Seed = &g.seed
+	}
+	return grammar, nil
+}
+
+// load builds the LSystem of the grammar, failing with all parser
+// diagnostics when any rule is malformed.
+func (g *grammarFlags) load() (*LSystem, *Grammar, error) {
+	grammar, err := g.readFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	var opts []Option
+	if g.threads > 0 {
+		opts = append(opts, WithWorkers(g.threads))
+	}
+	if g.maxTokens > 0 {
+		opts = append(opts, WithMaxTokens(g.maxTokens))
+	}
+	if g.maxMemory > 0 {
+		opts = append(opts, WithMaxMemory(g.maxMemory))
+	}
+	ls, err := grammar.NewLSystem(g.presample, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ls, grammar, nil
+}
+
+// context returns a context ending after the timeout, if any.
+func (g *grammarFlags) context() (context.Context, context.CancelFunc) {
+	if g.timeout > 0 {
+		return context.WithTimeout(context.Background(), g.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// profile starts the cpu profile if requested and returns the function
+// stopping it.
+func (g *grammarFlags) profile() (func(), error) {
+	if g.cpuprofile == "" {
+		return func() {}, nil
+	}
+	f, err := os.Create(g.cpuprofile)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}, nil
+}
@@ -1,36 +1,46 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	. "github.com/viktordanov/lsystem"
-	"log"
+	"fmt"
 	"os"
-	"runtime/pprof"
 )
 
-var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+const usage = `usage: lsystem <command> [flags]
+
+commands:
+  run     iterate a grammar and write the resulting tokens
+  stats   print the growth of a grammar per generation
+  serve   serve production rate charts over HTTP
+  render  draw the resulting tokens as SVG or voxels
+  lint    report problems in a grammar
+
+Run "lsystem <command> -h" for the flags of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"run":    runCommand,
+	"stats":  statsCommand,
+	"serve":  serveCommand,
+	"render": renderCommand,
+	"lint":   lintCommand,
+}
 
 func main() {
-	flag.Parse()
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
-
-	var catalystRules = map[Token]string{
-		"S":  `1 C9 A`,
-		"C4": `1 _`,
-		"A":  `1 *C A A; 1 *C A`,
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
 	}
-	vars, consts, rules := ParseRules(catalystRules)
-	ls := NewLSystem("S", rules, vars, consts, false)
-
-	for i := 0; i < 10; i++ {
-		ls.IterateOnce()
-		log.Println(ls.DecodeBytes(ls.MemPool.ReadAll()))
+	if err := command(os.Args[2:]); errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
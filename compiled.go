@@ -0,0 +1,347 @@
+package lsystem
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+)
+
+// WriteTo writes l compiled: the alphabet with the ids assigned to it, the
+// counter tables, the encoded rules with their pre-sampled choices, the seed
+// and the axiom, so that ReadLSystem restores it without parsing or encoding
+// anything. The rules as parsed are stored too, for the analyses that derive
+// fresh systems from them. The current generation is not, see Snapshot.
+func (l *LSystem) WriteTo(w io.Writer) (int64, error) {
+	b := appendHeader(nil, compiledMagic, compiledVersion)
+	b = appendString(b, string(l.Axiom))
+	b = appendTokens(b, l.Variables.Sorted())
+	b = appendTokens(b, l.Constants.Sorted())
+	b = appendTokens(b, l.contextIgnore)
+	keys := make([]Token, 0, len(l.Rules))
+	for key := range l.Rules {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	b = appendList(b, keys, func(b []byte, key Token) []byte {
+		rule := l.Rules[key]
+		b = appendString(b, string(key))
+		b = appendString(b, string(rule.Predecessor))
+		return appendNilable(b, rule.Weights, appendWeightedRule)
+	})
+
+	b = appendBool(b, l.useWeightPreSampling)
+	b = binary.LittleEndian.AppendUint64(b, l.seed)
+	b = appendTokens(b, l.BytesToken)
+	b = append(b, l.Params...)
+	b = appendList(b, l.ParamToByte, appendId)
+	b = appendId(b, l.EmptyTokenId)
+	b = appendList(b, l.ByteRules, func(b []byte, rule ByteProductionRule) []byte {
+		b = appendNilable(b, rule.Weights, appendByteWeightedRule)
+		b = appendId(b, rule.Predecessor)
+		b = appendBool(b, rule.Contextual)
+		b = appendBool(b, rule.Parametric)
+		return appendNilable(b, rule.PreSampledWeights, binary.LittleEndian.AppendUint16)
+	})
+	b = appendList(b, l.axiomIds, appendId)
+	for _, args := range l.axiomArgs {
+		if len(args) > maxModuleArgs {
+			return 0, ErrBinaryFormat
+		}
+	}
+	b = appendList(b, l.axiomArgs, appendFloats)
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadLSystem reads an LSystem written by LSystem.WriteTo. opts apply as they
+// do to NewLSystem, WithSeed pre-samples the rules again.
+func ReadLSystem(r io.Reader, opts ...Option) (*LSystem, error) {
+	d := newDecoder(r)
+	if err := d.header(compiledMagic, compiledVersion); err != nil {
+		return nil, err
+	}
+	l := &LSystem{
+		Axiom:     d.token(),
+		Variables: readTokenSet(d),
+		Constants: readTokenSet(d),
+		Rules:     make(map[Token]ProductionRule),
+		workers:   runtime.GOMAXPROCS(0),
+	}
+	l.contextIgnore = d.tokens()
+	for n := d.uvarint(math.MaxInt32); n > 0 && d.err == nil; n-- {
+		key := d.token()
+		l.Rules[key] = ProductionRule{Predecessor: d.token(), Weights: readNilable(d, math.MaxUint16, d.weightedRule)}
+	}
+
+	l.useWeightPreSampling = d.bool()
+	l.seed = d.uint64()
+	l.BytesToken = d.tokens()
+	d.alphabet = len(l.BytesToken)
+	l.Params = d.bytes(uint64(len(l.BytesToken)))
+	l.ParamToByte = readList(d, d.alphabet, d.id)
+	l.EmptyTokenId = d.id()
+	l.ByteRules = readList(d, d.alphabet, d.byteProductionRule)
+	l.axiomIds = readList(d, math.MaxInt32, d.id)
+	l.axiomArgs = readList(d, len(l.axiomIds), d.floats)
+	if d.err == nil && (len(l.ParamToByte) != d.alphabet || len(l.ByteRules) != d.alphabet || len(l.axiomArgs) != len(l.axiomIds)) {
+		d.fail()
+	}
+	// a counter state counts down to the id before it
+	for i, param := range l.Params {
+		if param > 1 && (i == 0 || l.Params[i-1] != param-1) {
+			d.fail()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	l.TokenBytes = make(map[Token]TokenStateId, len(l.BytesToken))
+	for i, t := range l.BytesToken {
+		l.TokenBytes[t] = NewTokenStateId(uint32(i), l.Params[i] > 0)
+	}
+	for _, rule := range l.ByteRules {
+		l.parametric = l.parametric || rule.Parametric
+	}
+	for _, args := range l.axiomArgs {
+		l.parametric = l.parametric || args != nil
+	}
+
+	seed := l.seed
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.indexTokens()
+	if l.seed != seed {
+		l.SetSeed(l.seed)
+	}
+	l.allocate()
+	return l, nil
+}
+
+func appendTokens(b []byte, tokens []Token) []byte {
+	return appendNilable(b, tokens, func(b []byte, t Token) []byte { return appendString(b, string(t)) })
+}
+
+func (d *decoder) tokens() []Token {
+	return readNilable(d, int(MaxTokenId), d.token)
+}
+
+func readTokenSet(d *decoder) TokenSet {
+	set := make(TokenSet)
+	for _, t := range d.tokens() {
+		set.Add(t)
+	}
+	return set
+}
+
+func appendStrings(b []byte, s []string) []byte {
+	return appendNilable(b, s, appendString)
+}
+
+func (d *decoder) strings() []string {
+	return readNilable(d, math.MaxUint16, d.string)
+}
+
+func appendWeightedRule(b []byte, wt WeightedRule) []byte {
+	b = appendFloat(b, wt.Probability)
+	b = appendString(b, string(wt.Catalyst))
+	b = appendTokens(b, wt.Left)
+	b = appendTokens(b, wt.Right)
+	b = appendTokens(b, wt.Tokens)
+	b = appendStrings(b, wt.Formals)
+	b = appendNilable(b, wt.LeftFormals, appendStrings)
+	b = appendNilable(b, wt.RightFormals, appendStrings)
+	b = appendString(b, wt.Condition)
+	return appendNilable(b, wt.Arguments, appendStrings)
+}
+
+func (d *decoder) weightedRule() WeightedRule {
+	return WeightedRule{
+		Probability:  d.float(),
+		Catalyst:     d.token(),
+		Left:         d.tokens(),
+		Right:        d.tokens(),
+		Tokens:       d.tokens(),
+		Formals:      d.strings(),
+		LeftFormals:  readNilable(d, math.MaxUint16, d.strings),
+		RightFormals: readNilable(d, math.MaxUint16, d.strings),
+		Condition:    d.string(),
+		Arguments:    readNilable(d, math.MaxUint16, d.strings),
+	}
+}
+
+func appendIds(b []byte, ids []TokenStateId) []byte {
+	return appendNilable(b, ids, appendId)
+}
+
+func (d *decoder) ids() []TokenStateId {
+	return readNilable(d, math.MaxInt32, d.id)
+}
+
+func appendInt(b []byte, n int) []byte {
+	return binary.AppendUvarint(b, uint64(n))
+}
+
+func (d *decoder) count() int {
+	return d.int(math.MaxUint16)
+}
+
+func appendByteWeightedRule(b []byte, wt ByteWeightedRule) []byte {
+	b = appendFloat(b, wt.LowerLimit)
+	b = appendFloat(b, wt.UpperLimit)
+	b = appendId(b, wt.Catalyst)
+	b = appendIds(b, wt.Left)
+	b = appendIds(b, wt.Right)
+	b = appendIds(b, wt.Successor)
+	b = appendInt(b, wt.Formals)
+	b = appendNilable(b, wt.LeftFormals, appendInt)
+	b = appendNilable(b, wt.RightFormals, appendInt)
+	b = appendExpression(b, wt.Condition)
+	return appendNilable(b, wt.Arguments, func(b []byte, args []*Expression) []byte {
+		return appendNilable(b, args, appendExpression)
+	})
+}
+
+// byteWeightedRule reads an alternative, failing unless the formals and
+// arguments it holds match its context and successor.
+func (d *decoder) byteWeightedRule() ByteWeightedRule {
+	wt := ByteWeightedRule{
+		LowerLimit:   d.float(),
+		UpperLimit:   d.float(),
+		Catalyst:     d.id(),
+		Left:         d.ids(),
+		Right:        d.ids(),
+		Successor:    d.ids(),
+		Formals:      d.count(),
+		LeftFormals:  readNilable(d, math.MaxUint16, d.count),
+		RightFormals: readNilable(d, math.MaxUint16, d.count),
+		Condition:    d.expression(),
+		Arguments: readNilable(d, math.MaxUint16, func() []*Expression {
+			return readNilable(d, math.MaxUint16, d.expression)
+		}),
+	}
+	if wt.LeftFormals != nil && len(wt.LeftFormals) != len(wt.Left) ||
+		wt.RightFormals != nil && len(wt.RightFormals) != len(wt.Right) ||
+		wt.Arguments != nil && len(wt.Arguments) != len(wt.Successor) {
+		d.fail()
+	}
+	return wt
+}
+
+func (d *decoder) byteProductionRule() ByteProductionRule {
+	rule := ByteProductionRule{
+		Weights:     readNilable(d, math.MaxUint16, d.byteWeightedRule),
+		Predecessor: d.id(),
+		Contextual:  d.bool(),
+		Parametric:  d.bool(),
+	}
+	rule.PreSampledWeights = readNilable(d, preSampleSize, d.uint16)
+	if rule.Weights != nil && len(rule.Weights) == 0 || rule.PreSampledWeights != nil && len(rule.PreSampledWeights) != preSampleSize {
+		d.fail()
+	}
+	for _, alt := range rule.PreSampledWeights {
+		if int(alt) >= len(rule.Weights) {
+			d.fail()
+		}
+	}
+	return rule
+}
+
+// Expressions are stored compiled, as their source followed by their syntax
+// tree in prefix order, since the names of their parameters are not kept.
+const (
+	constExpr byte = iota
+	paramExpr
+	unaryExpr
+	binaryExpr
+	callExpr
+)
+
+// appendExpression needs no limits of its own, expressions are only made by
+// CompileExpression and the decoder, which both keep to maxExprDepth.
+func appendExpression(b []byte, e *Expression) []byte {
+	if e == nil {
+		return append(b, 0)
+	}
+	b = append(b, 1)
+	b = appendString(b, e.Source)
+	return appendExprNode(b, e.root)
+}
+
+func appendExprNode(b []byte, node exprNode) []byte {
+	switch n := node.(type) {
+	case constNode:
+		return appendFloat(append(b, constExpr), float64(n))
+	case paramNode:
+		return appendInt(append(b, paramExpr), int(n))
+	case *unaryNode:
+		b = appendString(append(b, unaryExpr), n.op)
+		return appendExprNode(b, n.operand)
+	case *binaryNode:
+		b = appendString(append(b, binaryExpr), n.op)
+		return appendExprNode(appendExprNode(b, n.left), n.right)
+	default:
+		call := n.(*callNode)
+		b = appendString(append(b, callExpr), call.name)
+		return appendList(b, call.args, appendExprNode)
+	}
+}
+
+func (d *decoder) expression() *Expression {
+	if !d.bool() {
+		return nil
+	}
+	e := &Expression{Source: d.string()}
+	e.root = d.exprNode(0)
+	if d.err != nil {
+		return nil
+	}
+	return e
+}
+
+func (d *decoder) exprNode(depth int) exprNode {
+	if depth > maxExprDepth {
+		d.fail()
+	}
+	if d.err != nil {
+		return constNode(0)
+	}
+	switch d.byte() {
+	case constExpr:
+		return constNode(d.float())
+	case paramExpr:
+		return paramNode(d.int(math.MaxUint16))
+	case unaryExpr:
+		n := &unaryNode{op: d.string()}
+		if n.op != "-" && n.op != "!" {
+			d.fail()
+		}
+		n.operand = d.exprNode(depth + 1)
+		return n
+	case binaryExpr:
+		n := &binaryNode{op: d.string()}
+		switch n.op {
+		case "||", "&&", "<", "<=", ">", ">=", "==", "!=", "+", "-", "*", "/", "%", "^":
+		default:
+			d.fail()
+		}
+		n.left = d.exprNode(depth + 1)
+		n.right = d.exprNode(depth + 1)
+		return n
+	case callExpr:
+		n := &callNode{name: d.string()}
+		fn, ok := exprFunctions[n.name]
+		n.fn = fn.fn
+		n.args = readList(d, fn.arity, func() exprNode { return d.exprNode(depth + 1) })
+		if !ok || len(n.args) != fn.arity {
+			d.fail()
+		}
+		return n
+	}
+	d.fail()
+	return constNode(0)
+}
@@ -0,0 +1,178 @@
+package lsystem
+
+import "sort"
+
+// generationView gives random access to the generation being rewritten, which
+// may be split across the read buffers of the MemPool.
+type generationView struct {
+	buffers []*Buffer
+	offsets []int
+	len     int
+}
+
+func (l *LSystem) view() *generationView {
+	chunks := l.MemPool.Chunks()
+	gen := &generationView{buffers: make([]*Buffer, chunks), offsets: make([]int, chunks)}
+	for i := 0; i < chunks; i++ {
+		gen.buffers[i] = l.MemPool.GetReadBuffer(i)
+		gen.offsets[i] = gen.len
+		gen.len += gen.buffers[i].Len
+	}
+	return gen
+}
+
+// locate returns the buffer holding index and the index within it.
+func (g *generationView) locate(index int) (*Buffer, int) {
+	i := g.chunk(index)
+	return g.buffers[i], index - g.offsets[i]
+}
+
+// chunk returns the index of the buffer holding index. Empty buffers share
+// their offset with the next one, so the last buffer starting at or before
+// index is never empty.
+func (g *generationView) chunk(index int) int {
+	return max(sort.Search(len(g.offsets), func(i int) bool { return g.offsets[i] > index })-1, 0)
+}
+
+func (g *generationView) at(index int) TokenStateId {
+	buffer, i := g.locate(index)
+	return buffer.At(i)
+}
+
+func (g *generationView) args(index int) []float64 {
+	buffer, i := g.locate(index)
+	return buffer.ModuleArgs(i)
+}
+
+// previous returns the token before index, which may lie in another chunk,
+// or empty at the start of the generation.
+func (g *generationView) previous(index int, empty TokenStateId) TokenStateId {
+	if index == 0 {
+		return empty
+	}
+	return g.at(index - 1)
+}
+
+// noToken is never assigned to a token and stands in for missing brackets.
+const noToken = ^TokenStateId(0)
+
+func (l *LSystem) baseToken(t TokenStateId) TokenStateId {
+	if t.HasParam() {
+		return l.ParamToByte[t.TokenId()]
+	}
+	return t
+}
+
+func (l *LSystem) catalystAllows(catalyst, previousToken TokenStateId) bool {
+	return catalyst == l.EmptyTokenId || catalyst == l.baseToken(previousToken)
+}
+
+// bind matches the context of wt around index and appends the parameters the
+// alternative binds to env.
+func (l *LSystem) bind(gen *generationView, index int, wt *ByteWeightedRule, env []float64) ([]float64, bool) {
+	if wt.Formals > 0 {
+		env = appendFormals(env, gen.args(index), wt.Formals)
+	}
+	if !wt.HasContext() {
+		return env, true
+	}
+
+	var left, right []int
+	if wt.LeftFormals != nil || wt.RightFormals != nil {
+		left, right = make([]int, len(wt.Left)), make([]int, len(wt.Right))
+	}
+	if !l.matchLeft(gen, index, wt.Left, left) || !l.matchRight(gen, index, wt.Right, right) {
+		return env, false
+	}
+	for k, n := range wt.LeftFormals {
+		env = appendFormals(env, gen.args(left[k]), n)
+	}
+	for k, n := range wt.RightFormals {
+		env = appendFormals(env, gen.args(right[k]), n)
+	}
+	return env, true
+}
+
+// appendFormals appends the first n of args to env, padding missing ones with 0.
+func appendFormals(env, args []float64, n int) []float64 {
+	env = append(env, args[:min(n, len(args))]...)
+	for i := len(args); i < n; i++ {
+		env = append(env, 0)
+	}
+	return env
+}
+
+// matchLeft walks left from index, skipping ignored tokens and complete
+// branches, and stepping out of the branch index is in, so that the left
+// context of a token is its ancestor in the branching structure. The position
+// of each matched token is stored in matched unless it is nil.
+func (l *LSystem) matchLeft(gen *generationView, index int, pattern []TokenStateId, matched []int) bool {
+	i := index - 1
+	for p := len(pattern) - 1; p >= 0; p-- {
+		for ; i >= 0; i-- {
+			t := gen.at(i)
+			if t == l.branchEnd {
+				depth := 1
+				for i--; i >= 0 && depth > 0; i-- {
+					switch gen.at(i) {
+					case l.branchEnd:
+						depth++
+					case l.branchStart:
+						depth--
+					}
+				}
+				i++
+				continue
+			}
+			if t != l.branchStart && !l.contextIgnored[t.TokenId()] {
+				break
+			}
+		}
+		if i < 0 || l.baseToken(gen.at(i)) != pattern[p] {
+			return false
+		}
+		if matched != nil {
+			matched[p] = i
+		}
+		i--
+	}
+	return true
+}
+
+// matchRight walks right from index, skipping ignored tokens and the branches
+// starting there. The context ends with the branch index is in.
+func (l *LSystem) matchRight(gen *generationView, index int, pattern []TokenStateId, matched []int) bool {
+	i := index + 1
+	for p := 0; p < len(pattern); p++ {
+		for ; i < gen.len; i++ {
+			t := gen.at(i)
+			if t == l.branchStart {
+				depth := 1
+				for i++; i < gen.len && depth > 0; i++ {
+					switch gen.at(i) {
+					case l.branchStart:
+						depth++
+					case l.branchEnd:
+						depth--
+					}
+				}
+				i--
+				continue
+			}
+			if t == l.branchEnd {
+				return false
+			}
+			if !l.contextIgnored[t.TokenId()] {
+				break
+			}
+		}
+		if i >= gen.len || l.baseToken(gen.at(i)) != pattern[p] {
+			return false
+		}
+		if matched != nil {
+			matched[p] = i
+		}
+		i++
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package lsystem
+
+import (
+	"errors"
+	"math"
+	"math/big"
+)
+
+var (
+	ErrStochastic = errors.New("rules are not deterministic")
+	ErrOutOfRange = errors.New("index out of range")
+)
+
+// deterministicSuccessors returns what every token rewrites to, failing with
+// ErrStochastic unless every rule has a single alternative that always
+// applies.
+func (l *LSystem) deterministicSuccessors() ([][]TokenStateId, error) {
+	successors := make([][]TokenStateId, len(l.BytesToken))
+	for i := range successors {
+		token := NewTokenStateId(uint32(i), l.Params[i] > 0)
+		if token.HasParam() && l.Params[i] > 1 {
+			token--
+		}
+		successors[i] = []TokenStateId{token}
+		var alternative *ByteWeightedRule
+		for k := range l.ByteRules[token.TokenId()].Weights {
+			wt := &l.ByteRules[token.TokenId()].Weights[k]
+			if wt.UpperLimit == wt.LowerLimit {
+				continue
+			}
+			if alternative != nil || wt.Catalyst != l.EmptyTokenId || wt.HasContext() || wt.Condition != nil {
+				return nil, ErrStochastic
+			}
+			alternative = wt
+		}
+		if alternative != nil {
+			successors[i] = alternative.Successor
+		}
+	}
+	return successors, nil
+}
+
+// CountAt returns the exact number of every token, indexed by TokenId, in
+// generation n of a deterministic L-system. The production matrix is raised to
+// the power n by squaring, so the cost grows with log n and the size of the
+// counts rather than with the generation.
+func (l *LSystem) CountAt(n int) ([]*big.Int, error) {
+	successors, err := l.deterministicSuccessors()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, ErrOutOfRange
+	}
+	size := len(successors)
+	power := newBigMatrix(size)
+	for i, tokens := range successors {
+		for _, t := range tokens {
+			power[i][t.TokenId()].Add(power[i][t.TokenId()], big.NewInt(1))
+		}
+	}
+	counts := make([]*big.Int, size)
+	for i := range counts {
+		counts[i] = new(big.Int)
+	}
+	for _, id := range l.axiomIds {
+		counts[id.TokenId()].Add(counts[id.TokenId()], big.NewInt(1))
+	}
+
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			counts = power.apply(counts)
+		}
+		if n > 1 {
+			power = power.mul(power)
+		}
+	}
+	return counts, nil
+}
+
+// LenAt returns the exact number of tokens in generation n of a deterministic
+// L-system, see CountAt.
+func (l *LSystem) LenAt(n int) (*big.Int, error) {
+	counts, err := l.CountAt(n)
+	if err != nil {
+		return nil, err
+	}
+	total := new(big.Int)
+	for _, count := range counts {
+		total.Add(total, count)
+	}
+	return total, nil
+}
+
+// TokenAt returns the token at index of generation n of a deterministic
+// L-system by descending the derivation from the axiom, only ever looking at
+// the successors of one token per generation. Lengths are tracked up to
+// index+1, so they stop changing after a number of generations bounded by the
+// index, and from then on the descent repeats and is skipped ahead.
+func (l *LSystem) TokenAt(n, index int) (TokenStateId, error) {
+	successors, err := l.deterministicSuccessors()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || index < 0 {
+		return 0, ErrOutOfRange
+	}
+
+	// lengths[m][i] is the length of the generation m steps after token i,
+	// saturating at index+1 as longer ones always contain the index
+	limit := math.MaxInt
+	if index < limit {
+		limit = index + 1
+	}
+	lengths := [][]int{make([]int, len(successors))}
+	for i := range lengths[0] {
+		lengths[0][i] = 1
+	}
+	stable := false
+	lengthAt := func(m int, id TokenStateId) int {
+		for !stable && len(lengths) <= m {
+			previous := lengths[len(lengths)-1]
+			next := make([]int, len(previous))
+			stable = true
+			for i, tokens := range successors {
+				for _, t := range tokens {
+					next[i] = saturatingAdd(next[i], previous[t.TokenId()], limit)
+				}
+				stable = stable && next[i] == previous[i]
+			}
+			if !stable {
+				lengths = append(lengths, next)
+			}
+		}
+		// once stable later generations have the same lengths
+		return lengths[min(m, len(lengths)-1)][id.TokenId()]
+	}
+
+	// past the last stable generation a step only depends on the token and
+	// the index within it, so a repeated pair repeats until then
+	type step struct {
+		id    TokenStateId
+		index int
+	}
+	seen := make(map[step]int)
+	tokens := l.axiomIds
+	for m := n; ; m-- {
+		found := false
+		for _, t := range tokens {
+			length := lengthAt(m, t)
+			if index < length {
+				if last := len(lengths) - 1; stable && m > last {
+					if previous, ok := seen[step{t, index}]; ok {
+						period := previous - m
+						m -= (m - last) / period * period
+						clear(seen)
+					}
+					seen[step{t, index}] = m
+				}
+				if m == 0 {
+					return t, nil
+				}
+				tokens = successors[t.TokenId()]
+				found = true
+				break
+			}
+			index -= length
+		}
+		if !found {
+			return 0, ErrOutOfRange
+		}
+	}
+}
+
+// saturatingAdd returns a+b or limit when the sum exceeds it.
+func saturatingAdd(a, b, limit int) int {
+	if a > limit-b {
+		return limit
+	}
+	return a + b
+}
+
+type bigMatrix [][]*big.Int
+
+func newBigMatrix(size int) bigMatrix {
+	m := make(bigMatrix, size)
+	for i := range m {
+		m[i] = make([]*big.Int, size)
+		for j := range m[i] {
+			m[i][j] = new(big.Int)
+		}
+	}
+	return m
+}
+
+func (m bigMatrix) mul(other bigMatrix) bigMatrix {
+	product := newBigMatrix(len(m))
+	term := new(big.Int)
+	for i := range m {
+		for k, a := range m[i] {
+			if a.Sign() == 0 {
+				continue
+			}
+			for j, b := range other[k] {
+				if b.Sign() != 0 {
+					product[i][j].Add(product[i][j], term.Mul(a, b))
+				}
+			}
+		}
+	}
+	return product
+}
+
+// apply returns the counts of the generation m steps after one with counts.
+func (m bigMatrix) apply(counts []*big.Int) []*big.Int {
+	next := make([]*big.Int, len(counts))
+	for j := range next {
+		next[j] = new(big.Int)
+	}
+	term := new(big.Int)
+	for i, count := range counts {
+		if count.Sign() == 0 {
+			continue
+		}
+		for j, produced := range m[i] {
+			if produced.Sign() != 0 {
+				next[j].Add(next[j], term.Mul(count, produced))
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,68 @@
+package lsystem
+
+import "sync/atomic"
+
+// WithRuleCounters counts, for every alternative, how often it was chosen and
+// how often its catalyst blocked it, see RuleCounts. Counting costs an atomic
+// add per token rewritten, generations aborted by a limit are counted too.
+func WithRuleCounters() Option {
+	return func(l *LSystem) {
+		l.countRules = true
+	}
+}
+
+// ruleCounters holds the counts of all alternatives, those of the rule of token
+// id starting at offsets[id].
+type ruleCounters struct {
+	offsets  []int
+	selected []atomic.Int64
+	blocked  []atomic.Int64
+}
+
+func newRuleCounters(rules []ByteProductionRule) *ruleCounters {
+	c := &ruleCounters{offsets: make([]int, len(rules))}
+	total := 0
+	for id := range rules {
+		c.offsets[id] = total
+		total += len(rules[id].Weights)
+	}
+	c.selected = make([]atomic.Int64, total)
+	c.blocked = make([]atomic.Int64, total)
+	return c
+}
+
+func (c *ruleCounters) add(token TokenStateId, alt int, blocked bool) {
+	if alt < 0 {
+		return
+	}
+	i := c.offsets[token.TokenId()] + alt
+	c.selected[i].Add(1)
+	if blocked {
+		c.blocked[i].Add(1)
+	}
+}
+
+// RuleCounts reports every alternative with the counts recorded since the last
+// Reset, nil unless counting is enabled.
+func (l *LSystem) RuleCounts() []AlternativeReport {
+	if l.counters == nil {
+		return nil
+	}
+	reports := l.declaredAlternatives()
+	visits := make(map[Token]int)
+	for i := range reports {
+		r := &reports[i]
+		k := l.counters.offsets[l.TokenBytes[r.Token].TokenId()] + r.Alternative
+		r.Selected = int(l.counters.selected[k].Load())
+		r.Blocked = int(l.counters.blocked[k].Load())
+		visits[r.Token] += r.Selected
+	}
+	for i := range reports {
+		r := &reports[i]
+		if visits[r.Token] > 0 {
+			r.Empirical = float64(r.Selected) / float64(visits[r.Token])
+			r.Effective = float64(r.Selected-r.Blocked) / float64(visits[r.Token])
+		}
+	}
+	return reports
+}
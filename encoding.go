@@ -0,0 +1,359 @@
+package lsystem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	ErrBinaryFormat  = errors.New("malformed or truncated binary data")
+	ErrBinaryVersion = errors.New("unsupported binary format version")
+)
+
+// The binary formats of this package start with one of these and a version
+// byte. Integers are varints, floats little-endian IEEE 754.
+var (
+	snapshotMagic = [4]byte{'L', 'S', 'Y', 'S'}
+	compiledMagic = [4]byte{'L', 'S', 'Y', 'C'}
+	streamMagic   = [4]byte{'L', 'S', 'Y', 'T'}
+)
+
+// Version 2 of snapshots stores the tokens as token streams do, packed to the
+// width of the alphabet.
+const (
+	snapshotVersion = 2
+	compiledVersion = 1
+	streamVersion   = 1
+)
+
+// TokenStream is a token string encoded with the ids of an LSystem together
+// with the alphabet naming them, so that it can be stored and compared across
+// processes and restored into any system sharing the tokens.
+type TokenStream struct {
+	// Alphabet names the ids in Tokens, Alphabet[id.TokenId()] being the
+	// token of id.
+	Alphabet []Token
+	Tokens   []TokenStateId
+	// Args holds the arguments of every token, nil unless the system is
+	// parametric.
+	Args [][]float64
+}
+
+// Stream returns the current generation of l as a TokenStream.
+func (l *LSystem) Stream() *TokenStream {
+	ts := &TokenStream{
+		Alphabet: append([]Token(nil), l.BytesToken...),
+		Tokens:   make([]TokenStateId, 0, l.Len()),
+	}
+	l.Walk(func(t TokenStateId, args []float64) bool {
+		ts.Tokens = append(ts.Tokens, t)
+		if l.parametric {
+			ts.Args = append(ts.Args, append([]float64(nil), args...))
+		}
+		return true
+	})
+	return ts
+}
+
+// MapStream returns the tokens of ts with the ids of l, failing with
+// ErrUnknownToken for tokens outside the alphabet of l.
+func (l *LSystem) MapStream(ts *TokenStream) ([]TokenStateId, error) {
+	ids := make([]TokenStateId, len(ts.Alphabet))
+	for i, t := range ts.Alphabet {
+		id, exists := l.TokenBytes[t]
+		if !exists {
+			id = noToken
+		}
+		ids[i] = id
+	}
+	tokens := make([]TokenStateId, len(ts.Tokens))
+	for i, t := range ts.Tokens {
+		if int(t.TokenId()) >= len(ids) {
+			return nil, ErrBinaryFormat
+		}
+		if ids[t.TokenId()] == noToken {
+			return nil, fmt.Errorf("%w %q", ErrUnknownToken, ts.Alphabet[t.TokenId()])
+		}
+		tokens[i] = ids[t.TokenId()]
+	}
+	return tokens, nil
+}
+
+// Modules decodes ts without the LSystem it was taken from.
+func (ts *TokenStream) Modules() []Module {
+	modules := make([]Module, len(ts.Tokens))
+	for i, t := range ts.Tokens {
+		modules[i].Token = ts.Alphabet[t.TokenId()]
+		if ts.Args != nil {
+			modules[i].Args = ts.Args[i]
+		}
+	}
+	return modules
+}
+
+// WriteTo writes ts with its alphabet, the ids packed with the narrowest width
+// able to hold them, see AppendPackedIds.
+func (ts *TokenStream) WriteTo(w io.Writer) (int64, error) {
+	b, err := appendStream(appendHeader(nil, streamMagic, streamVersion), ts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadTokenStream reads a stream written by TokenStream.WriteTo.
+func ReadTokenStream(r io.Reader) (*TokenStream, error) {
+	d := newDecoder(r)
+	if err := d.header(streamMagic, streamVersion); err != nil {
+		return nil, err
+	}
+	ts := d.stream()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return ts, nil
+}
+
+func appendHeader(b []byte, magic [4]byte, version byte) []byte {
+	b = append(b, magic[:]...)
+	return append(b, version)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// appendList writes the length of items followed by every item.
+func appendList[T any](b []byte, items []T, item func([]byte, T) []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(items)))
+	for _, it := range items {
+		b = item(b, it)
+	}
+	return b
+}
+
+// appendNilable is appendList keeping nil apart from empty, writing 0 for nil
+// and the length plus one otherwise.
+func appendNilable[T any](b []byte, items []T, item func([]byte, T) []byte) []byte {
+	if items == nil {
+		return append(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(len(items))+1)
+	for _, it := range items {
+		b = item(b, it)
+	}
+	return b
+}
+
+func appendId(b []byte, id TokenStateId) []byte {
+	return binary.AppendUvarint(b, uint64(id))
+}
+
+func appendFloats(b []byte, fs []float64) []byte {
+	return appendNilable(b, fs, appendFloat)
+}
+
+func appendStream(b []byte, ts *TokenStream) ([]byte, error) {
+	b = appendList(b, ts.Alphabet, func(b []byte, t Token) []byte { return appendString(b, string(t)) })
+	width := idWidth(len(ts.Alphabet))
+	b = append(b, byte(width))
+	b = binary.AppendUvarint(b, uint64(len(ts.Tokens)))
+	b, err := AppendPackedIds(b, ts.Tokens, width)
+	if err != nil {
+		return b, err
+	}
+	if ts.Args != nil && len(ts.Args) != len(ts.Tokens) {
+		return b, ErrBinaryFormat
+	}
+	for _, args := range ts.Args {
+		if len(args) > maxModuleArgs {
+			return b, ErrBinaryFormat
+		}
+	}
+	return appendNilable(b, ts.Args, appendFloats), nil
+}
+
+// decoder reads the binary formats of this package, remembering the first
+// error. Lengths above their limit count as corruption, and lists grow only as
+// their items arrive, so that damaged data cannot make it allocate more than
+// it holds.
+type decoder struct {
+	r   *bufio.Reader
+	err error
+	// alphabet is the number of tokens ids read are checked against.
+	alphabet int
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r)}
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrBinaryFormat
+	}
+}
+
+func (d *decoder) header(magic [4]byte, version byte) error {
+	var m [4]byte
+	d.read(m[:])
+	if d.err != nil || m != magic {
+		return ErrBinaryFormat
+	}
+	if v := d.byte(); d.err != nil {
+		return d.err
+	} else if v != version {
+		return fmt.Errorf("%w %d", ErrBinaryVersion, v)
+	}
+	return nil
+}
+
+func (d *decoder) read(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		d.fail()
+	}
+}
+
+func (d *decoder) byte() byte {
+	var b [1]byte
+	d.read(b[:])
+	return b[0]
+}
+
+func (d *decoder) bool() bool {
+	b := d.byte()
+	if b > 1 {
+		d.fail()
+	}
+	return b == 1
+}
+
+func (d *decoder) uint16() uint16 {
+	var b [2]byte
+	d.read(b[:])
+	return binary.LittleEndian.Uint16(b[:])
+}
+
+func (d *decoder) uint64() uint64 {
+	var b [8]byte
+	d.read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+func (d *decoder) float() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *decoder) uvarint(limit uint64) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil || n > limit {
+		d.fail()
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) int(limit int) int {
+	return int(d.uvarint(uint64(limit)))
+}
+
+// bytes reads n bytes, growing the result only as the data arrives.
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		d.fail()
+	}
+	return buf.Bytes()
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint(math.MaxUint16)))
+}
+
+func (d *decoder) token() Token {
+	return Token(d.string())
+}
+
+// id reads a TokenStateId, which must belong to the alphabet.
+func (d *decoder) id() TokenStateId {
+	id := TokenStateId(d.uvarint(math.MaxUint32))
+	if int(id.TokenId()) >= d.alphabet {
+		d.fail()
+		return 0
+	}
+	return id
+}
+
+func (d *decoder) floats() []float64 {
+	return readNilable(d, maxModuleArgs, d.float)
+}
+
+// readList reads a length no greater than limit followed by that many items.
+func readList[T any](d *decoder, limit int, item func() T) []T {
+	var items []T
+	for n := d.uvarint(uint64(limit)); n > 0 && d.err == nil; n-- {
+		items = append(items, item())
+	}
+	return items
+}
+
+// readNilable reads a list written by appendNilable.
+func readNilable[T any](d *decoder, limit int, item func() T) []T {
+	n := d.uvarint(uint64(limit) + 1)
+	if n == 0 {
+		return nil
+	}
+	items := make([]T, 0, min(n-1, 64))
+	for ; n > 1 && d.err == nil; n-- {
+		items = append(items, item())
+	}
+	return items
+}
+
+func (d *decoder) stream() *TokenStream {
+	ts := &TokenStream{Alphabet: readList(d, int(MaxTokenId), d.token)}
+	width := int(d.byte())
+	if d.err != nil || width != idWidth(len(ts.Alphabet)) {
+		d.fail()
+		return nil
+	}
+	count := d.uvarint(math.MaxInt32)
+	ts.Tokens = UnpackIds(d.bytes(count*uint64(width/8)), width)
+	for _, t := range ts.Tokens {
+		if int(t.TokenId()) >= len(ts.Alphabet) {
+			d.fail()
+		}
+	}
+	ts.Args = readNilable(d, int(count), d.floats)
+	if ts.Args != nil && len(ts.Args) != len(ts.Tokens) {
+		d.fail()
+	}
+	return ts
+}
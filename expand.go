@@ -0,0 +1,168 @@
+package lsystem
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrContextual = errors.New("context-sensitive rules need the whole generation")
+
+// Expand derives generation n depth first and calls fn with every token of it
+// and its arguments, in order, without storing the generation. Memory use is
+// proportional to n times the longest successor. The tokens are the ones
+// IterateUntil(n) produces; the current generation is left untouched.
+// Expand stops early when fn returns false and fails with ErrContextual for
+// rules with a left or right context.
+func (l *LSystem) Expand(n int, fn func(t TokenStateId, args []float64) bool) error {
+	return l.ExpandContext(context.Background(), n, fn)
+}
+
+// ExpandContext is Expand returning an *AbortError when ctx is done or more
+// tokens than allowed by WithMaxTokens were produced.
+func (l *LSystem) ExpandContext(ctx context.Context, n int, fn func(t TokenStateId, args []float64) bool) error {
+	for i := range l.ByteRules {
+		if l.ByteRules[i].Contextual {
+			return ErrContextual
+		}
+	}
+
+	e := &expander{
+		ctx:       ctx,
+		l:         l,
+		n:         n,
+		fn:        fn,
+		seeds:     make([]uint64, n),
+		positions: make([]int, n),
+		last:      make([]TokenStateId, n),
+		envs:      make([][]float64, n),
+		values:    make([][]float64, n),
+		scratch:   &Buffer{ids32: make([]TokenStateId, 1), width: 32, Cap: 1, ArgIndex: make([]int32, 1)},
+	}
+	e.gen = &generationView{buffers: []*Buffer{e.scratch}, offsets: []int{0}, len: 1}
+	for level := 0; level < n; level++ {
+		e.seeds[level] = generationSeed(l.seed, level)
+		e.last[level] = l.EmptyTokenId
+	}
+	for i, id := range l.axiomIds {
+		if !e.visit(0, id, l.axiomArgs[i]) {
+			break
+		}
+	}
+	return e.err
+}
+
+// ExpandTo writes generation n to w as ids packed to IdWidth bits, see Expand
+// and UnpackIds.
+func (l *LSystem) ExpandTo(w io.Writer, n int) error {
+	bw := bufio.NewWriter(w)
+	width := l.IdWidth()
+	var buf []byte
+	var err error
+	expandErr := l.Expand(n, func(t TokenStateId, _ []float64) bool {
+		buf, err = AppendPackedIds(buf[:0], []TokenStateId{t}, width)
+		if err == nil {
+			_, err = bw.Write(buf)
+		}
+		return err == nil
+	})
+	if expandErr != nil {
+		return expandErr
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// expander keeps, for every generation, the position of the next token and
+// the last token seen, which is all rule selection needs from the generation.
+type expander struct {
+	ctx context.Context
+	l   *LSystem
+	n   int
+	fn  func(t TokenStateId, args []float64) bool
+
+	emitted int
+	err     error
+
+	seeds     []uint64
+	positions []int
+	last      []TokenStateId
+	envs      [][]float64
+	values    [][]float64
+
+	// scratch holds the module being rewritten for binding its parameters
+	scratch *Buffer
+	gen     *generationView
+}
+
+func (e *expander) visit(level int, token TokenStateId, args []float64) bool {
+	if level == e.n {
+		e.emitted++
+		if (e.emitted%checkInterval == 0 || e.l.maxTokens > 0 && e.emitted > e.l.maxTokens) && !e.check() {
+			return false
+		}
+		return e.fn(token, args)
+	}
+	l := e.l
+	index := e.positions[level]
+	e.positions[level]++
+	predecessor := e.last[level]
+	e.last[level] = token
+
+	if token.HasParam() && l.Params[token.TokenId()] > 1 {
+		token--
+	}
+	rules := &l.ByteRules[token.TokenId()]
+	if rules.Weights == nil {
+		return e.visit(level+1, token, args)
+	}
+	random := positionSample(e.seeds[level], index)
+
+	if !l.parametric {
+		for _, successor := range rules.ChooseSuccessor(l, predecessor, random) {
+			if !e.visit(level+1, successor, nil) {
+				return false
+			}
+		}
+		return true
+	}
+
+	e.scratch.Clear()
+	e.scratch.AppendModule(token, args)
+	alt, blocked, env := rules.chooseAlternative(l, e.gen, 0, predecessor, random, e.envs[level])
+	e.envs[level] = env
+	if alt < 0 || blocked {
+		return e.visit(level+1, token, args)
+	}
+
+	wt := &rules.Weights[alt]
+	for k, successor := range wt.Successor {
+		// deeper levels only use their own slots, so env stays intact
+		values := e.values[level][:0]
+		if wt.Arguments != nil {
+			for _, arg := range wt.Arguments[k] {
+				values = append(values, arg.Eval(env))
+			}
+		}
+		e.values[level] = values
+		if !e.visit(level+1, successor, values) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *expander) check() bool {
+	err := e.ctx.Err()
+	if err == nil && e.l.maxTokens > 0 && e.emitted > e.l.maxTokens {
+		err = ErrTokenLimit
+	}
+	if err != nil {
+		e.err = &AbortError{Generation: e.n, Tokens: e.emitted, Err: err}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package lsystem
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Report holds the statistics of a derivation in a form that marshals to JSON,
+// see WriteJSON and WriteCSV.
+type Report struct {
+	Seed        uint64             `json:"seed"`
+	Generations []GenerationReport `json:"generations"`
+	// Alternatives lists every alternative of every rule, ordered by token.
+	Alternatives []AlternativeReport `json:"alternatives"`
+	// Rates is only filled in by callers, see RateReports.
+	Rates []RateReport `json:"rates,omitempty"`
+}
+
+// GenerationReport counts the tokens of a generation, 0 being the axiom.
+type GenerationReport struct {
+	Generation int           `json:"generation"`
+	Length     int           `json:"length"`
+	Counts     map[Token]int `json:"counts"`
+}
+
+// AlternativeReport compares the declared weight of an alternative, as a share
+// of the weights of its rule, with how often it was chosen while deriving.
+// Selected counts every choice, Blocked those where the catalyst did not match
+// and the token was kept instead. Empirical is the share of the choices of the
+// rule that fell on the alternative and tends to Weight, Effective the share
+// that were not blocked, which is how often the alternative really fires.
+type AlternativeReport struct {
+	Token       Token   `json:"token"`
+	Alternative int     `json:"alternative"`
+	Weight      float64 `json:"weight"`
+	Selected    int     `json:"selected"`
+	Blocked     int     `json:"blocked"`
+	Empirical   float64 `json:"empirical"`
+	Effective   float64 `json:"effective"`
+}
+
+// RateReport is a ProductionRate as exported, with the rule written out.
+type RateReport struct {
+	Token Token  `json:"token"`
+	Rule  string `json:"rule"`
+	GrowthStats
+}
+
+func (pr *ProductionRate) Report() RateReport {
+	rule := ""
+	if pr.Rule != nil {
+		rule = pr.Rule.String()
+	}
+	return RateReport{Token: pr.Token, Rule: rule, GrowthStats: pr.Stats}
+}
+
+// MarshalJSON writes the RateReport of pr together with the sampled ratios.
+// The histogram in Rates is left out, it follows from the ratios.
+func (pr ProductionRate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RateReport
+		Ratios []float64 `json:"ratios"`
+	}{pr.Report(), pr.Ratios})
+}
+
+// RateReports returns the reports of rates ordered by token.
+func RateReports(rates map[Token]ProductionRate) []RateReport {
+	reports := make([]RateReport, 0, len(rates))
+	for _, token := range sortedRateTokens(rates) {
+		rate := rates[token]
+		reports = append(reports, rate.Report())
+	}
+	return reports
+}
+
+// Report derives generations 1 to n from the axiom with the seed and options
+// of l and reports them; l itself is left untouched. When the derivation is
+// aborted the generations derived so far are reported along with the error.
+func (l *LSystem) Report(ctx context.Context, n int) (*Report, error) {
+	return l.report(ctx, n, l.maxTokens)
+}
+
+func (l *LSystem) report(ctx context.Context, n, maxTokens int) (*Report, error) {
+	ls, err := NewValidatedLSystem(l.Axiom, l.Rules, l.Variables, l.Constants, l.useWeightPreSampling,
+		WithSeed(l.seed), WithWorkers(l.workers), WithMaxTokens(maxTokens), WithMaxMemory(l.maxBytes),
+		WithContextIgnore(l.contextIgnore...), WithRuleCounters())
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Seed: l.seed}
+	measure := func(g int) {
+		counts := make([]int, len(ls.BytesToken))
+		ls.Walk(func(t TokenStateId, _ []float64) bool {
+			counts[t.TokenId()]++
+			return true
+		})
+		generation := GenerationReport{Generation: g, Length: ls.Len(), Counts: make(map[Token]int)}
+		for id, count := range counts {
+			if count > 0 {
+				generation.Counts[ls.BytesToken[id]] = count
+			}
+		}
+		report.Generations = append(report.Generations, generation)
+	}
+
+	measure(0)
+	for g := 1; g <= n && err == nil; g++ {
+		if err = ls.IterateContext(ctx, 1); err == nil {
+			measure(g)
+		}
+	}
+	report.Alternatives = ls.RuleCounts()
+	return report, err
+}
+
+// declaredAlternatives lists the alternatives of all rules ordered by token,
+// with their weights.
+func (l *LSystem) declaredAlternatives() []AlternativeReport {
+	tokens := make([]Token, 0, len(l.Rules))
+	for t := range l.Rules {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+
+	var reports []AlternativeReport
+	for _, t := range tokens {
+		rules := &l.ByteRules[l.TokenBytes[t].TokenId()]
+		total := 0.0
+		if len(rules.Weights) > 0 {
+			total = rules.Weights[len(rules.Weights)-1].UpperLimit
+		}
+		for k, wt := range rules.Weights {
+			weight := 0.0
+			if total > 0 {
+				weight = (wt.UpperLimit - wt.LowerLimit) / total
+			}
+			reports = append(reports, AlternativeReport{Token: t, Alternative: k, Weight: weight})
+		}
+	}
+	return reports
+}
+
+// WriteJSON writes r as a single JSON object.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes r as one value per row, ready to be pivoted. Alternatives
+// have the metrics weight, selected, blocked, empirical and effective, rates
+// those of GrowthStats with percentiles named p50 and so on:
+//
+//	kind,generation,token,alternative,metric,value
+//	generation,3,,,length,5
+//	generation,3,A,,count,3
+//	alternative,,B,0,selected,12
+//	rate,,A,,mean,1.5
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	num := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	cw.Write([]string{"kind", "generation", "token", "alternative", "metric", "value"})
+	for _, g := range r.Generations {
+		generation := strconv.Itoa(g.Generation)
+		cw.Write([]string{"generation", generation, "", "", "length", strconv.Itoa(g.Length)})
+		tokens := make([]Token, 0, len(g.Counts))
+		for t := range g.Counts {
+			tokens = append(tokens, t)
+		}
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+		for _, t := range tokens {
+			cw.Write([]string{"generation", generation, string(t), "", "count", strconv.Itoa(g.Counts[t])})
+		}
+	}
+	for _, a := range r.Alternatives {
+		alternative := strconv.Itoa(a.Alternative)
+		cw.Write([]string{"alternative", "", string(a.Token), alternative, "weight", num(a.Weight)})
+		cw.Write([]string{"alternative", "", string(a.Token), alternative, "selected", strconv.Itoa(a.Selected)})
+		cw.Write([]string{"alternative", "", string(a.Token), alternative, "blocked", strconv.Itoa(a.Blocked)})
+		cw.Write([]string{"alternative", "", string(a.Token), alternative, "empirical", num(a.Empirical)})
+		cw.Write([]string{"alternative", "", string(a.Token), alternative, "effective", num(a.Effective)})
+	}
+	for _, rate := range r.Rates {
+		row := func(metric string, value float64) {
+			cw.Write([]string{"rate", "", string(rate.Token), "", metric, num(value)})
+		}
+		row("samples", float64(rate.Samples))
+		row("mean", rate.Mean)
+		row("variance", rate.Variance)
+		row("min", rate.Min)
+		row("max", rate.Max)
+		for _, p := range rate.Percentiles {
+			row("p"+num(p.Rank), p.Value)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,436 @@
+package lsystem
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrMalformedExpression = errors.New("malformed expression")
+
+// Limits on the nesting of expressions and the arguments of a module, kept by
+// the parsers so that everything parsed can be written in the binary formats.
+const (
+	maxExprDepth  = 256
+	maxModuleArgs = math.MaxUint8
+)
+
+// Expression is a compiled arithmetic expression over the parameters of a
+// module. Comparisons and logical operators evaluate to 1 or 0.
+type Expression struct {
+	Source string
+	root   exprNode
+}
+
+// CompileExpression compiles src. names lists the parameters in the order
+// their values are passed to Eval.
+func CompileExpression(src string, names []string) (*Expression, error) {
+	p := exprParser{src: src, names: names}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil && p.tok != "" {
+		err = p.errorf("unexpected %q", p.tok)
+	}
+	if err == nil && exprDepth(root) > maxExprDepth {
+		err = fmt.Errorf("%w: nested deeper than %d", ErrMalformedExpression, maxExprDepth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{Source: src, root: root}, nil
+}
+
+func (e *Expression) Eval(env []float64) float64 {
+	return e.root.eval(env)
+}
+
+func (e *Expression) String() string {
+	return e.Source
+}
+
+type exprNode interface {
+	eval(env []float64) float64
+}
+
+// exprDepth returns the number of nodes below node on the longest path.
+func exprDepth(node exprNode) int {
+	switch n := node.(type) {
+	case *unaryNode:
+		return exprDepth(n.operand) + 1
+	case *binaryNode:
+		return max(exprDepth(n.left), exprDepth(n.right)) + 1
+	case *callNode:
+		depth := 0
+		for _, arg := range n.args {
+			depth = max(depth, exprDepth(arg)+1)
+		}
+		return depth
+	}
+	return 0
+}
+
+type constNode float64
+
+func (n constNode) eval([]float64) float64 { return float64(n) }
+
+type paramNode int
+
+func (n paramNode) eval(env []float64) float64 {
+	if int(n) >= len(env) {
+		return 0
+	}
+	return env[n]
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env []float64) float64 {
+	v := n.operand.eval(env)
+	if n.op == "-" {
+		return -v
+	}
+	return truth(v == 0)
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env []float64) float64 {
+	l := n.left.eval(env)
+	switch n.op {
+	case "&&":
+		return truth(l != 0 && n.right.eval(env) != 0)
+	case "||":
+		return truth(l != 0 || n.right.eval(env) != 0)
+	}
+	r := n.right.eval(env)
+	switch n.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "%":
+		return math.Mod(l, r)
+	case "^":
+		return math.Pow(l, r)
+	case "<":
+		return truth(l < r)
+	case "<=":
+		return truth(l <= r)
+	case ">":
+		return truth(l > r)
+	case ">=":
+		return truth(l >= r)
+	case "==":
+		return truth(l == r)
+	default: // "!="
+		return truth(l != r)
+	}
+}
+
+type callNode struct {
+	name string
+	fn   func(args []float64) float64
+	args []exprNode
+}
+
+func (n *callNode) eval(env []float64) float64 {
+	var buf [4]float64
+	args := buf[:0]
+	for _, arg := range n.args {
+		args = append(args, arg.eval(env))
+	}
+	return n.fn(args)
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var exprConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+var exprFunctions = map[string]struct {
+	arity int
+	fn    func(args []float64) float64
+}{
+	"sin":   {1, func(a []float64) float64 { return math.Sin(a[0]) }},
+	"cos":   {1, func(a []float64) float64 { return math.Cos(a[0]) }},
+	"tan":   {1, func(a []float64) float64 { return math.Tan(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+}
+
+type exprParser struct {
+	src   string
+	pos   int
+	start int
+	tok   string
+	names []string
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w at offset %d: %s", ErrMalformedExpression, p.start, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n') {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+	case isIdentStart(c):
+		for p.pos < len(p.src) && (isIdentStart(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+		if p.pos < len(p.src) {
+			pair := p.src[p.pos-1 : p.pos+1]
+			switch pair {
+			case "<=", ">=", "==", "!=", "&&", "||":
+				p.pos++
+			}
+		}
+	}
+	p.tok = p.src[p.start:p.pos]
+}
+
+func (p *exprParser) parseBinary(ops []string, operand func() (exprNode, error)) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for contains(ops, p.tok) {
+		op := p.tok
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary([]string{"||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary([]string{"&&"}, p.parseComparison)
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	return p.parseBinary([]string{"<", "<=", ">", ">=", "==", "!="}, p.parseSum)
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.tok == "-" || p.tok == "!" {
+		op := p.tok
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	if p.tok == "+" {
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+func (p *exprParser) parsePower() (exprNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "^" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: "^", left: base, right: exponent}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end")
+	case tok == "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return inner, nil
+	case isDigit(tok[0]) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", tok)
+		}
+		p.next()
+		return constNode(v), nil
+	case isIdentStart(tok[0]):
+		p.next()
+		if p.tok == "(" {
+			return p.parseCall(tok)
+		}
+		for i, name := range p.names {
+			if name == tok {
+				return paramNode(i), nil
+			}
+		}
+		if v, ok := exprConstants[tok]; ok {
+			return constNode(v), nil
+		}
+		return nil, p.errorf("unknown parameter %q", tok)
+	}
+	return nil, p.errorf("unexpected %q", tok)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	fn, ok := exprFunctions[name]
+	if !ok {
+		return nil, p.errorf("unknown function %q", name)
+	}
+	p.next()
+	call := &callNode{name: name, fn: fn.fn}
+	for p.tok != ")" {
+		if len(call.args) > 0 {
+			if p.tok != "," {
+				return nil, p.errorf("expected , or )")
+			}
+			p.next()
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next()
+	if len(call.args) != fn.arity {
+		return nil, p.errorf("%s takes %d arguments", name, fn.arity)
+	}
+	return call, nil
+}
+
+func contains(ops []string, tok string) bool {
+	for _, op := range ops {
+		if op == tok {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// splitModule splits a module such as "F(l*0.8, w)" into its name and the
+// source of its arguments. ok is false when the parentheses are unbalanced or
+// there are more than maxModuleArgs arguments.
+func splitModule(text string) (name string, args []string, ok bool) {
+	open := strings.IndexByte(text, '(')
+	if open < 0 {
+		return text, nil, !strings.ContainsRune(text, ')')
+	}
+	if open == 0 || text[len(text)-1] != ')' {
+		return "", nil, false
+	}
+
+	depth, start := 0, open+1
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 && i != len(text)-1 {
+				return "", nil, false
+			}
+		case ',':
+			if depth == 1 {
+				args = append(args, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+		if depth < 0 {
+			return "", nil, false
+		}
+	}
+	if depth != 0 {
+		return "", nil, false
+	}
+	last := strings.TrimSpace(text[start : len(text)-1])
+	if last != "" || len(args) > 0 {
+		args = append(args, last)
+	}
+	return text[:open], args, len(args) <= maxModuleArgs
+}
@@ -0,0 +1,435 @@
+package lsystem
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrUnknownDirective   = errors.New("unknown directive")
+	ErrMalformedDirective = errors.New("malformed directive")
+	ErrMalformedRule      = errors.New("malformed rule")
+	ErrDuplicateRule      = errors.New("duplicate rule")
+)
+
+// GrammarError describes a problem with a line of a grammar file.
+type GrammarError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *GrammarError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v %q", e.Line, e.Err, e.Text)
+}
+
+func (e *GrammarError) Unwrap() error {
+	return e.Err
+}
+
+// Grammar is an L-system as stored in a grammar file:
+//
+//	# a comment
+//	@axiom F [ n L ] u S
+//	@iterations 10
+//	@seed 42
+//	@variables A B
+//	@constants + -
+//	@counter C 9
+//	@ignore + -
+//	@hint angle 25
+//
+//	S -> 1 C9 A
+//	A -> 1 *C A A;
+//		1 *C A
+//
+// Rules are written as "key -> groups" and continue on indented lines.
+// Comments take up whole lines and are kept with the rule that follows them,
+// or in its body between its lines. Those before directives belong to the
+// file, those after the last rule end it.
+type Grammar struct {
+	Comments    []string
+	EndComments []string
+	Axiom       Token
+	Iterations  int
+	Seed        *uint64
+	// Variables and Constants declare tokens, overriding the classification
+	// by capitalisation. When any are declared rules may only reference
+	// declared tokens and predecessors.
+	Variables []Token
+	Constants []Token
+	Counters  []Counter
+	Ignore    []Token
+	Hints     []Hint
+	Rules     []GrammarRule
+}
+
+// Counter declares the states C1 to C<Max> of the stateful variable C.
+type Counter struct {
+	Token Token
+	Max   uint8
+}
+
+// Hint is a free-form setting for interpreters, such as the turn angle.
+type Hint struct {
+	Key   string
+	Value string
+}
+
+type GrammarRule struct {
+	Comments []string
+	Key      Token
+	// Body holds the groups of the rule, with a line break before every
+	// continuation line, and the comments between them.
+	Body string
+
+	// Line and Column locate Body in the file it was loaded from.
+	Line    int
+	Column  int
+	indents []int
+}
+
+func (g *Grammar) Hint(key string) (string, bool) {
+	for _, hint := range g.Hints {
+		if hint.Key == key {
+			return hint.Value, true
+		}
+	}
+	return "", false
+}
+
+// maxGrammarLine bounds the length of a line of a grammar file.
+const maxGrammarLine = 16 << 20
+
+// LoadGrammar reads a grammar file, stopping at the first malformed line.
+// The rules themselves are only parsed by ParseRules.
+func LoadGrammar(r io.Reader) (*Grammar, error) {
+	g := &Grammar{}
+	var comments []string
+	var rule *GrammarRule
+	// inner holds the comments after the last line of rule, which are part of
+	// it when it continues after them
+	var inner []string
+	var innerIndents []int
+	keys := make(TokenSet)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxGrammarLine)
+	line := 1
+	for ; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		fail := func(err error) (*Grammar, error) {
+			return nil, &GrammarError{Line: line, Text: trimmed, Err: err}
+		}
+		if rule != nil && trimmed != "" && trimmed[0] == '#' {
+			inner = append(inner, trimmed)
+			innerIndents = append(innerIndents, strings.Index(text, trimmed))
+			continue
+		}
+		if rule != nil && trimmed != "" && unicode.IsSpace(rune(text[0])) {
+			for _, comment := range inner {
+				rule.Body += "\n" + comment
+			}
+			rule.Body += "\n" + trimmed
+			rule.indents = append(append(rule.indents, innerIndents...), strings.Index(text, trimmed))
+			inner, innerIndents = nil, nil
+			continue
+		}
+		comments = append(comments, inner...)
+		inner, innerIndents = nil, nil
+
+		switch {
+		case trimmed == "":
+			rule = nil
+		case trimmed[0] == '#':
+			comments = append(comments, trimmed)
+		case trimmed[0] == '@':
+			if err := g.directive(trimmed); err != nil {
+				return fail(err)
+			}
+			g.Comments = append(g.Comments, comments...)
+			comments = nil
+			rule = nil
+		default:
+			key, body, found := cutRule(text)
+			key = strings.TrimSpace(key)
+			if !found || key == "" {
+				return fail(ErrMalformedRule)
+			}
+			if keys.Contains(Token(key)) {
+				return fail(ErrDuplicateRule)
+			}
+			keys.Add(Token(key))
+
+			trimmedBody := strings.TrimLeftFunc(body, unicode.IsSpace)
+			g.Rules = append(g.Rules, GrammarRule{
+				Comments: comments,
+				Key:      Token(key),
+				Body:     strings.TrimRightFunc(trimmedBody, unicode.IsSpace),
+				Line:     line,
+				Column:   1 + len(text) - len(trimmedBody),
+			})
+			rule = &g.Rules[len(g.Rules)-1]
+			comments = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &GrammarError{Line: line, Err: err}
+	}
+	comments = append(comments, inner...)
+	if len(g.Rules) > 0 {
+		g.EndComments = comments
+	} else {
+		g.Comments = append(g.Comments, comments...)
+	}
+	return g, nil
+}
+
+// cutRule splits a rule line into its key and body at the last "->" outside
+// of parentheses, which bodies never contain.
+func cutRule(text string) (key, body string, found bool) {
+	depth, arrow := 0, -1
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '(':
+			depth++
+		case ')':
+			depth = max(depth-1, 0)
+		case '-':
+			if depth == 0 && strings.HasPrefix(text[i:], "->") {
+				arrow = i
+			}
+		}
+	}
+	if arrow < 0 {
+		return text, "", false
+	}
+	return text[:arrow], text[arrow+2:], true
+}
+
+func (g *Grammar) directive(line string) error {
+	name, rest, _ := strings.Cut(line[1:], " ")
+	args := strings.Fields(rest)
+	single := func() (string, error) {
+		if len(args) != 1 {
+			return "", ErrMalformedDirective
+		}
+		return args[0], nil
+	}
+
+	switch name {
+	case "axiom":
+		if len(args) == 0 {
+			return ErrMalformedDirective
+		}
+		g.Axiom = Token(strings.TrimSpace(rest))
+	case "iterations":
+		n, err := single()
+		if err != nil {
+			return err
+		}
+		if g.Iterations, err = strconv.Atoi(n); err != nil || g.Iterations < 0 {
+			return ErrMalformedDirective
+		}
+	case "seed":
+		s, err := single()
+		if err != nil {
+			return err
+		}
+		seed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return ErrMalformedDirective
+		}
+		g.Seed = &seed
+	case "variables":
+		g.Variables = append(g.Variables, symbolsToTokens(args)...)
+	case "constants":
+		g.Constants = append(g.Constants, symbolsToTokens(args)...)
+	case "counter":
+		if len(args) != 2 {
+			return ErrMalformedDirective
+		}
+		n, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil || n == 0 {
+			return ErrMalformedDirective
+		}
+		g.Counters = append(g.Counters, Counter{Token: Token(args[0]), Max: uint8(n)})
+	case "ignore":
+		g.Ignore = append(g.Ignore, symbolsToTokens(args)...)
+	case "hint":
+		key, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		if key == "" {
+			return ErrMalformedDirective
+		}
+		g.Hints = append(g.Hints, Hint{Key: key, Value: strings.TrimSpace(value)})
+	default:
+		return ErrUnknownDirective
+	}
+	return nil
+}
+
+// SaveGrammar writes g in the format read by LoadGrammar.
+func SaveGrammar(w io.Writer, g *Grammar) error {
+	bw := bufio.NewWriter(w)
+	tokens := func(directive string, tokens []Token) {
+		if len(tokens) == 0 {
+			return
+		}
+		bw.WriteString(directive)
+		for _, t := range tokens {
+			bw.WriteString(" " + string(t))
+		}
+		bw.WriteString("\n")
+	}
+
+	for _, comment := range g.Comments {
+		bw.WriteString(comment + "\n")
+	}
+	if g.Axiom != "" {
+		bw.WriteString("@axiom " + string(g.Axiom) + "\n")
+	}
+	if g.Iterations != 0 {
+		bw.WriteString("@iterations " + strconv.Itoa(g.Iterations) + "\n")
+	}
+	if g.Seed != nil {
+		bw.WriteString("@seed " + strconv.FormatUint(*g.Seed, 10) + "\n")
+	}
+	tokens("@variables", g.Variables)
+	tokens("@constants", g.Constants)
+	for _, counter := range g.Counters {
+		bw.WriteString("@counter " + string(counter.Token) + " " + strconv.Itoa(int(counter.Max)) + "\n")
+	}
+	tokens("@ignore", g.Ignore)
+	for _, hint := range g.Hints {
+		bw.WriteString(strings.TrimSpace("@hint "+hint.Key+" "+hint.Value) + "\n")
+	}
+
+	for _, rule := range g.Rules {
+		bw.WriteString("\n")
+		for _, comment := range rule.Comments {
+			bw.WriteString(comment + "\n")
+		}
+		bw.WriteString(string(rule.Key) + " -> " + strings.ReplaceAll(rule.Body, "\n", "\n\t") + "\n")
+	}
+	if len(g.EndComments) > 0 {
+		bw.WriteString("\n")
+	}
+	for _, comment := range g.EndComments {
+		bw.WriteString(comment + "\n")
+	}
+	return bw.Flush()
+}
+
+// ParseRules parses the rules of g and applies its declarations. Diagnostics
+// of rules loaded from a file point into that file.
+func (g *Grammar) ParseRules(opts ParseOptions) (vars, consts TokenSet, rules map[Token]ProductionRule, warnings ParseErrors, err error) {
+	rulesMap := make(map[Token]string, len(g.Rules))
+	for _, rule := range g.Rules {
+		rulesMap[rule.Key] = rule.groups()
+	}
+
+	declared := make(TokenSet)
+	for _, t := range append(append(append([]Token{}, g.Variables...), g.Constants...), g.Ignore...) {
+		declared.Add(t)
+	}
+	for _, counter := range g.Counters {
+		declared.Add(counter.Token)
+		for _, t := range counter.states() {
+			declared.Add(t)
+		}
+	}
+	if opts.Alphabet == nil && len(g.Variables)+len(g.Constants) > 0 {
+		opts.Alphabet = declared
+	}
+
+	strict := opts.Strict
+	opts.Strict = false
+	vars, consts, rules, warnings, _ = ParseRulesWithOptions(rulesMap, opts)
+	g.locate(warnings)
+	if strict && len(warnings) > 0 {
+		return nil, nil, nil, nil, warnings
+	}
+
+	for _, t := range g.Variables {
+		delete(consts, t)
+		vars.Add(t)
+	}
+	for _, t := range g.Constants {
+		delete(vars, t)
+		consts.Add(t)
+	}
+	for _, counter := range g.Counters {
+		for _, t := range counter.states() {
+			delete(consts, t)
+			vars.Add(t)
+		}
+	}
+	return vars, consts, rules, warnings, nil
+}
+
+// groups returns the body of r without its comments, which are left as empty
+// lines so that diagnostics keep their position.
+func (r *GrammarRule) groups() string {
+	lines := strings.Split(r.Body, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// locate turns the positions of diagnostics into positions in the file.
+func (g *Grammar) locate(diagnostics ParseErrors) {
+	for _, d := range diagnostics {
+		for _, rule := range g.Rules {
+			if rule.Key != d.Rule || rule.Line == 0 {
+				continue
+			}
+			if d.Group < 0 {
+				d.Line = rule.Line
+				break
+			}
+			if d.Line == 1 {
+				d.Column += rule.Column - 1
+			} else if d.Line-2 < len(rule.indents) {
+				d.Column += rule.indents[d.Line-2]
+			}
+			d.Line += rule.Line - 1
+		}
+	}
+}
+
+// NewLSystem builds the L-system of g, failing with all diagnostics when any
+// rule is malformed. The grammar's seed is used unless opts set another.
+func (g *Grammar) NewLSystem(presample bool, opts ...Option) (*LSystem, error) {
+	vars, consts, rules, _, err := g.ParseRules(ParseOptions{Strict: true})
+	if err != nil {
+		return nil, err
+	}
+	var grammarOpts []Option
+	if g.Seed != nil {
+		grammarOpts = append(grammarOpts, WithSeed(*g.Seed))
+	}
+	if len(g.Ignore) > 0 {
+		grammarOpts = append(grammarOpts, WithContextIgnore(g.Ignore...))
+	}
+	return NewValidatedLSystem(g.Axiom, rules, vars, consts, presample, append(grammarOpts, opts...)...)
+}
+
+func (c Counter) states() []Token {
+	states := make([]Token, c.Max)
+	for k := range states {
+		states[k] = Token(string(c.Token) + strconv.Itoa(k+1))
+	}
+	return states
+}
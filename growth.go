@@ -0,0 +1,187 @@
+package lsystem
+
+import (
+	"context"
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// GrowthSeries follows generations 0 to Generations over several seeded runs.
+// Runs stopped by the token limit only contribute the generations they
+// reached.
+type GrowthSeries struct {
+	Generations int
+	Runs        int
+	Length      Band
+	// Depth is the deepest nesting of branches.
+	Depth  Band
+	Counts map[Token]Band
+}
+
+// Band holds the minimum, mean and maximum of a value across runs, indexed by
+// generation.
+type Band struct {
+	Min, Mean, Max []float64
+}
+
+func newBand(n int) Band {
+	return Band{Min: make([]float64, n), Mean: make([]float64, n), Max: make([]float64, n)}
+}
+
+// AnalyseGrowth derives generations from the axiom of l in opts.Runs runs
+// seeded opts.Seed, opts.Seed+1, ... and measures every generation; l itself
+// is left untouched. Runs stop at opts.MaxTokens and at the memory limit of l.
+func (l *LSystem) AnalyseGrowth(generations int, opts AnalysisOptions) *GrowthSeries {
+	gs, _ := l.AnalyseGrowthContext(context.Background(), generations, opts)
+	return gs
+}
+
+// AnalyseGrowthContext is AnalyseGrowth returning the error of ctx once it is
+// done.
+func (l *LSystem) AnalyseGrowthContext(ctx context.Context, generations int, opts AnalysisOptions) (*GrowthSeries, error) {
+	opts = opts.withDefaults()
+	n := generations + 1
+	// runs[r][g] holds the length, depth and counts of generation g of run r
+	type measure struct {
+		length, depth int
+		counts        map[Token]int
+	}
+	runs := make([][]measure, opts.Runs)
+	for run := range runs {
+		ls, err := NewValidatedLSystem(l.Axiom, l.Rules, l.Variables, l.Constants, false,
+			WithSeed(opts.Seed+uint64(run)), WithMaxTokens(opts.MaxTokens), WithMaxMemory(l.maxBytes), WithContextIgnore(l.contextIgnore...))
+		if err != nil {
+			return nil, err
+		}
+		for g := 0; g < n; g++ {
+			if g > 0 && ls.IterateContext(ctx, 1) != nil {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				break
+			}
+			m := measure{length: ls.Len(), counts: make(map[Token]int)}
+			counts := make([]int, len(ls.BytesToken))
+			depth := 0
+			ls.Walk(func(t TokenStateId, _ []float64) bool {
+				counts[t.TokenId()]++
+				switch t {
+				case ls.branchStart:
+					depth++
+					m.depth = max(m.depth, depth)
+				case ls.branchEnd:
+					depth--
+				}
+				return true
+			})
+			// every run registers the tokens in its own order
+			for id, count := range counts {
+				if count > 0 {
+					m.counts[ls.BytesToken[id]] = count
+				}
+			}
+			runs[run] = append(runs[run], m)
+		}
+	}
+
+	band := func(value func(m measure) int) Band {
+		b := newBand(n)
+		for g := 0; g < n; g++ {
+			reached := 0
+			for _, measures := range runs {
+				if g >= len(measures) {
+					continue
+				}
+				v := float64(value(measures[g]))
+				if reached == 0 || v < b.Min[g] {
+					b.Min[g] = v
+				}
+				b.Max[g] = max(b.Max[g], v)
+				b.Mean[g] += v
+				reached++
+			}
+			if reached > 0 {
+				b.Mean[g] /= float64(reached)
+			}
+		}
+		return b
+	}
+
+	gs := &GrowthSeries{
+		Generations: generations,
+		Runs:        opts.Runs,
+		Length:      band(func(m measure) int { return m.length }),
+		Depth:       band(func(m measure) int { return m.depth }),
+		Counts:      make(map[Token]Band),
+	}
+	for _, measures := range runs {
+		for _, m := range measures {
+			for t := range m.counts {
+				if _, exists := gs.Counts[t]; !exists {
+					gs.Counts[t] = band(func(m measure) int { return m.counts[t] })
+				}
+			}
+		}
+	}
+	return gs, nil
+}
+
+// Charts returns line charts of the length, branch depth and token counts
+// versus generation. Length and depth show the minimum and maximum across
+// runs around the mean, the counts only their mean.
+func (gs *GrowthSeries) Charts() []*charts.Line {
+	generations := make([]string, gs.Generations+1)
+	for g := range generations {
+		generations[g] = strconv.Itoa(g)
+	}
+	line := func(title string) *charts.Line {
+		chart := charts.NewLine()
+		chart.SetGlobalOptions(
+			charts.WithTitleOpts(opts.Title{Title: title, Subtitle: strconv.Itoa(gs.Runs) + " runs"}),
+			charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "axis"}),
+			charts.WithXAxisOpts(opts.XAxis{Name: "generation"}),
+			charts.WithLegendOpts(opts.Legend{Show: true, Type: "scroll", Top: "bottom"}),
+		)
+		chart.SetXAxis(generations)
+		return chart
+	}
+	data := func(values []float64) []opts.LineData {
+		items := make([]opts.LineData, len(values))
+		for i, v := range values {
+			items[i] = opts.LineData{Value: v}
+		}
+		return items
+	}
+	banded := func(title string, b Band) *charts.Line {
+		dashed := charts.WithLineStyleOpts(opts.LineStyle{Type: "dashed", Opacity: 0.6})
+		return line(title).
+			AddSeries("min", data(b.Min), dashed).
+			AddSeries("mean", data(b.Mean)).
+			AddSeries("max", data(b.Max), dashed)
+	}
+
+	counts := line("Tokens")
+	tokens := make([]Token, 0, len(gs.Counts))
+	for t := range gs.Counts {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	for _, t := range tokens {
+		counts.AddSeries(string(t), data(gs.Counts[t].Mean))
+	}
+	return []*charts.Line{banded("Length", gs.Length), banded("Branch depth", gs.Depth), counts}
+}
+
+// Render writes the charts of gs as a standalone HTML page.
+func (gs *GrowthSeries) Render(w io.Writer) error {
+	page := components.NewPage()
+	page.PageTitle = "Growth"
+	for _, chart := range gs.Charts() {
+		page.AddCharts(chart)
+	}
+	return page.Render(w)
+}
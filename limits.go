@@ -0,0 +1,118 @@
+package lsystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	ErrTokenLimit  = errors.New("token limit exceeded")
+	ErrMemoryLimit = errors.New("memory limit exceeded")
+)
+
+// AbortError reports why and where an iteration stopped early: Err is
+// ErrTokenLimit, ErrMemoryLimit or the error of the context. Generation is
+// the generation being derived, Tokens and Bytes its size so far.
+type AbortError struct {
+	Generation int
+	Tokens     int
+	Bytes      int
+	Err        error
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("aborted at generation %d with %d tokens (%d bytes): %v", e.Generation, e.Tokens, e.Bytes, e.Err)
+}
+
+func (e *AbortError) Unwrap() error {
+	return e.Err
+}
+
+// WithMaxTokens limits the number of tokens a generation may hold.
+func WithMaxTokens(n int) Option {
+	return func(l *LSystem) {
+		l.maxTokens = n
+	}
+}
+
+// WithMaxMemory limits the bytes held by the buffers of the MemPool. Within a
+// generation the size is estimated from the number of tokens produced.
+func WithMaxMemory(bytes int) Option {
+	return func(l *LSystem) {
+		l.maxBytes = bytes
+	}
+}
+
+// checkInterval is the number of tokens rewritten between checks of the
+// context and the limits.
+const checkInterval = 1024
+
+// limiter tracks a generation being derived by several workers and stops all
+// of them once the context is done or a limit is exceeded.
+type limiter struct {
+	ctx        context.Context
+	l          *LSystem
+	generation int
+	baseBytes  int
+	tokenBytes int
+	produced   atomic.Int64
+	failed     atomic.Pointer[AbortError]
+}
+
+// newLimiter returns nil when there is nothing to check, which the rewriting
+// loops treat as unlimited.
+func (l *LSystem) newLimiter(ctx context.Context) *limiter {
+	if ctx.Done() == nil && l.maxTokens <= 0 && l.maxBytes <= 0 {
+		return nil
+	}
+	tokenBytes := l.MemPool.IdWidth() / 8
+	if l.parametric {
+		tokenBytes += 4
+	}
+	return &limiter{
+		ctx:        ctx,
+		l:          l,
+		generation: l.generation + 1,
+		baseBytes:  l.MemPool.Bytes(),
+		tokenBytes: tokenBytes,
+	}
+}
+
+// add records tokens produced since the last call and reports whether
+// rewriting may go on.
+func (lim *limiter) add(tokens int) bool {
+	if lim == nil {
+		return true
+	}
+	if lim.failed.Load() != nil {
+		return false
+	}
+	total := int(lim.produced.Add(int64(tokens)))
+	bytes := lim.baseBytes + total*lim.tokenBytes
+	var err error
+	switch {
+	case lim.ctx.Err() != nil:
+		err = lim.ctx.Err()
+	case lim.l.maxTokens > 0 && total > lim.l.maxTokens:
+		err = ErrTokenLimit
+	case lim.l.maxBytes > 0 && bytes > lim.l.maxBytes:
+		err = ErrMemoryLimit
+	}
+	if err == nil {
+		return true
+	}
+	lim.failed.CompareAndSwap(nil, &AbortError{Generation: lim.generation, Tokens: total, Bytes: bytes, Err: err})
+	return false
+}
+
+func (lim *limiter) err() error {
+	if lim == nil {
+		return nil
+	}
+	if err := lim.failed.Load(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package lsystem
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrUnreachableRule    = errors.New("rule unreachable from the axiom")
+	ErrMissingRule        = errors.New("variable without rule")
+	ErrSuspiciousToken    = errors.New("capitalised token ending in _ is a constant")
+	ErrNonPositiveWeight  = errors.New("weight is not positive")
+	ErrUnproducedCatalyst = errors.New("catalyst never produced")
+	ErrMissingCounterRule = errors.New("no rule for any decremented counter state")
+	ErrDeadAlternative    = errors.New("alternative can never fire")
+)
+
+// Lint reports likely mistakes in rules that parse fine:
+//   - rules never applied to any token derived from the axiom
+//   - derived variables without a rule, which are kept as they are
+//   - capitalised tokens ending in _, which are constants
+//   - alternatives whose weight is zero or negative
+//   - catalysts that neither the axiom nor any successor contains
+//   - counters without a rule for any of the states they count down to
+//   - alternatives whose context contains tokens that are never derived
+//
+// Diagnostics about a token rather than an alternative have Group -1, none of
+// them have a position.
+func Lint(axiom Token, rules map[Token]ProductionRule, vars, consts TokenSet) ParseErrors {
+	var diagnostics ParseErrors
+	report := func(rule Token, group int, text Token, err error) {
+		diagnostics = append(diagnostics, &ParseError{Rule: rule, Group: group, Text: string(text), Err: err})
+	}
+
+	modules, _, _ := parseAxiom(axiom)
+	variable := func(t Token) bool {
+		return vars.Contains(t) || !consts.Contains(t) && isVariable(t)
+	}
+	tokens := make(TokenSet)
+	for _, m := range modules {
+		tokens.Add(m.Token)
+	}
+	for t := range vars {
+		tokens.Add(t)
+	}
+	for t := range consts {
+		tokens.Add(t)
+	}
+	// the empty token stands for a missing catalyst
+	delete(tokens, "")
+
+	// counters as registered by NewLSystem
+	counters := make(map[Token]uint8)
+	for t := range tokens {
+		if base, state, ok := tryParseStatefulVariable(t); ok && variable(t) {
+			counters[Token(base)] = max(counters[Token(base)], state)
+		}
+	}
+	counterState := func(t Token) (Token, uint8, bool) {
+		base, state, ok := tryParseStatefulVariable(t)
+		if !ok || counters[Token(base)] == 0 {
+			return "", 0, false
+		}
+		return Token(base), state, true
+	}
+	// effective is the token whose rule rewrites t, counter states count down
+	// before their rule is looked up
+	effective := func(t Token) Token {
+		if base, state, ok := counterState(t); ok && state > 1 {
+			return base + Token(strconv.Itoa(int(state-1)))
+		}
+		return t
+	}
+
+	derived := make(TokenSet)
+	applied := make(TokenSet)
+	var queue []Token
+	derive := func(t Token) {
+		if !derived.Contains(t) {
+			derived.Add(t)
+			queue = append(queue, t)
+		}
+	}
+	for _, m := range modules {
+		derive(m.Token)
+	}
+	for len(queue) > 0 {
+		t := effective(queue[0])
+		queue = queue[1:]
+		rule, exists := rules[t]
+		if !exists {
+			derive(t)
+			continue
+		}
+		applied.Add(t)
+		for _, wt := range rule.Weights {
+			if wt.Probability <= 0 {
+				continue
+			}
+			for _, successor := range wt.Tokens {
+				derive(successor)
+			}
+		}
+	}
+	// catalysts match every state of a counter
+	produced := make(TokenSet)
+	for t := range derived {
+		produced.Add(t)
+		if base, _, ok := counterState(t); ok {
+			produced.Add(base)
+		}
+	}
+
+	keys := make([]Token, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if !applied.Contains(key) {
+			report(key, -1, key, ErrUnreachableRule)
+		}
+		for group, wt := range rules[key].Weights {
+			switch {
+			case wt.Probability <= 0:
+				report(key, group, Token(strconv.FormatFloat(wt.Probability, 'g', -1, 64)), ErrNonPositiveWeight)
+			case wt.Catalyst != "" && !produced.Contains(wt.Catalyst):
+				report(key, group, wt.Catalyst, ErrUnproducedCatalyst)
+			default:
+				for _, t := range append(append([]Token{}, wt.Left...), wt.Right...) {
+					if !derived.Contains(t) {
+						report(key, group, t, ErrDeadAlternative)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	sorted := make([]Token, 0, len(tokens))
+	for t := range tokens {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, t := range sorted {
+		_, _, isCounter := counterState(t)
+		switch {
+		case isCapitalized(t) && !isVariable(t):
+			report(t, -1, t, ErrSuspiciousToken)
+		case variable(t) && !isCounter && derived.Contains(t) && rules[t].Weights == nil:
+			report(t, -1, t, ErrMissingRule)
+		}
+	}
+
+	bases := make([]Token, 0, len(counters))
+	for base := range counters {
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	for _, base := range bases {
+		if counters[base] == 1 {
+			continue
+		}
+		found := false
+		for state := 1; state < int(counters[base]); state++ {
+			_, found = rules[base+Token(strconv.Itoa(state))]
+			if found {
+				break
+			}
+		}
+		if !found {
+			report(base, -1, base, ErrMissingCounterRule)
+		}
+	}
+	return diagnostics
+}
+
+// Lint parses the rules of g leniently and lints them, see Lint. Diagnostics
+// point to the lines of the rules they are about.
+func (g *Grammar) Lint() ParseErrors {
+	vars, consts, rules, warnings, _ := g.ParseRules(ParseOptions{})
+	diagnostics := Lint(g.Axiom, rules, vars, consts)
+	for _, d := range diagnostics {
+		for _, rule := range g.Rules {
+			if context, err := parseKey(rule.Key); err == nil && context.Predecessor == d.Rule {
+				d.Line, d.Column = rule.Line, 1
+				break
+			}
+		}
+	}
+	return append(warnings, diagnostics...)
+}
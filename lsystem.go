@@ -1,10 +1,14 @@
 package lsystem
 
 import (
+	"context"
 	"fmt"
+	"pgregory.net/rand"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type LSystem struct {
@@ -14,93 +18,311 @@ type LSystem struct {
 	Constants TokenSet
 
 	useWeightPreSampling bool
+	seed                 uint64
+	generation           int
+	workers              int
+	maxTokens            int
+	maxBytes             int
+
+	// trace holds the derivations of every complete generation when tracing
+	// is enabled, tracing those of the generation being written.
+	traceEnabled bool
+	trace        [][]Derivation
+	tracing      []Derivation
+	countRules   bool
+	counters     *ruleCounters
+
+	contextIgnore  []Token
+	contextIgnored []bool
+	branchStart    TokenStateId
+	branchEnd      TokenStateId
+
+	parametric bool
+	axiomIds   []TokenStateId
+	axiomArgs  [][]float64
 
 	EmptyTokenId TokenStateId
 	TokenBytes   map[Token]TokenStateId
-	BytesToken   [255]Token
-	ByteRules    [255]ByteProductionRule
-	ParamToByte  [255]TokenStateId
+	BytesToken   []Token
+	ByteRules    []ByteProductionRule
+	ParamToByte  []TokenStateId
 
-	Params  [128]uint8
+	Params  []uint8
 	MemPool *MemPool
 }
 
-func NewLSystem(axiom Token, rulesMap map[Token]ProductionRule, vars TokenSet, consts TokenSet, useWeightPreSampling bool) *LSystem {
+type Option func(*LSystem)
+
+// WithSeed makes every derivation reproducible: the same seed, rules and number
+// of iterations always produce the same tokens. Without it a random seed is used.
+func WithSeed(seed uint64) Option {
+	return func(l *LSystem) {
+		l.seed = seed
+	}
+}
+
+// WithWorkers sets the number of goroutines rewriting a generation in
+// parallel. It defaults to GOMAXPROCS, 1 rewrites sequentially.
+func WithWorkers(n int) Option {
+	return func(l *LSystem) {
+		l.workers = n
+	}
+}
+
+// WithContextIgnore lists tokens, typically turtle commands, that are skipped
+// when matching the left and right context of rules. Branches delimited by
+// "[" and "]" are always skipped.
+func WithContextIgnore(tokens ...Token) Option {
+	return func(l *LSystem) {
+		l.contextIgnore = append(l.contextIgnore, tokens...)
+	}
+}
+
+// NewLSystem builds an L-system deriving axiom with the rules. The axiom is
+// not checked: tokens outside the alphabet stay as they are and malformed
+// arguments are left out, see NewValidatedLSystem.
+func NewLSystem(axiom Token, rulesMap map[Token]ProductionRule, vars TokenSet, consts TokenSet, useWeightPreSampling bool, opts ...Option) *LSystem {
 	lSystem := &LSystem{
 		Axiom:     axiom,
 		Rules:     rulesMap,
 		Variables: vars,
 		Constants: consts,
-		MemPool:   NewMemPool(32),
 
 		useWeightPreSampling: useWeightPreSampling,
+		seed:                 rand.Uint64(),
+		workers:              runtime.GOMAXPROCS(0),
+	}
+	for _, opt := range opts {
+		opt(lSystem)
 	}
-
 	lSystem.encodeTokens()
-	lSystem.Reset()
+	lSystem.allocate()
 	return lSystem
 }
 
-func (l *LSystem) Recreate(byteRules [255]ByteProductionRule) *LSystem {
+// NewValidatedLSystem is NewLSystem failing with the diagnostics of
+// ValidateAxiom when the axiom is invalid.
+func NewValidatedLSystem(axiom Token, rulesMap map[Token]ProductionRule, vars TokenSet, consts TokenSet, useWeightPreSampling bool, opts ...Option) (*LSystem, error) {
+	if err := ValidateAxiom(axiom, vars, consts); err != nil {
+		return nil, err
+	}
+	return NewLSystem(axiom, rulesMap, vars, consts, useWeightPreSampling, opts...), nil
+}
+
+// allocate sets up the buffers and loads the axiom.
+func (l *LSystem) allocate() {
+	l.workers = max(l.workers, 1)
+	// more chunks than workers leave room for balancing
+	l.MemPool = NewMemPoolWithWidth(32, 4*l.workers, l.IdWidth())
+	if l.parametric {
+		l.MemPool.EnableArgs()
+	}
+	l.Reset()
+}
+
+func (l *LSystem) Recreate(byteRules []ByteProductionRule) *LSystem {
 	clone := *l
 	clone.ByteRules = byteRules
 	return &clone
 }
 
-func (l *LSystem) RecreateWithMemPool(byteRules [255]ByteProductionRule, pool *MemPool) *LSystem {
+func (l *LSystem) RecreateWithMemPool(byteRules []ByteProductionRule, pool *MemPool) *LSystem {
 	clone := *l
 	clone.ByteRules = byteRules
 	clone.MemPool = pool
+	pool.Widen(clone.IdWidth())
+	if clone.parametric {
+		pool.EnableArgs()
+	}
 	return &clone
 }
 
+// encodeTokens assigns ids to the variables, the constants, the axiom tokens
+// outside the alphabet and the counter states, in this order and each sorted,
+// so that the same rules get the same ids in every process.
 func (l *LSystem) encodeTokens() {
-	l.TokenBytes = make(map[Token]TokenStateId)
-	l.BytesToken = [255]Token{}
-	i := uint8(0)
-
+	tokenCount := len(l.Variables) + len(l.Constants)
+	l.TokenBytes = make(map[Token]TokenStateId, tokenCount)
+	l.BytesToken = make([]Token, 0, tokenCount)
+	l.ParamToByte = make([]TokenStateId, 0, tokenCount)
+	l.Params = make([]uint8, 0, tokenCount)
+
+	// counter states are only registered below, with consecutive ids so that
+	// they count down by decrementing
 	statefulVarParams := make(map[Token]uint8)
-	for t := range l.Variables {
+	registerVariable := func(t Token) {
 		baseVar, numberState, isStateful := tryParseStatefulVariable(t)
 		if isStateful {
-			baseVar := Token(baseVar)
-			if _, exists := statefulVarParams[baseVar]; !exists {
-				statefulVarParams[baseVar] = numberState
+			statefulVarParams[Token(baseVar)] = max(numberState, statefulVarParams[Token(baseVar)])
+			if t == Token(baseVar+strconv.Itoa(int(numberState))) {
+				return
 			}
-			statefulVarParams[baseVar] = max(numberState, statefulVarParams[baseVar])
 		}
-		bytePair := NewTokenStateId(i, false)
-		l.TokenBytes[t] = bytePair
-		l.BytesToken[bytePair] = t
-		i++
+		l.registerToken(t, false)
+	}
+	for _, t := range l.Variables.Sorted() {
+		registerVariable(t)
 	}
 
-	for t := range l.Constants {
-		bytePair := NewTokenStateId(i, false)
-		l.TokenBytes[t] = bytePair
-		l.BytesToken[bytePair] = t
-		i++
+	for _, t := range l.Constants.Sorted() {
+		l.registerToken(t, false)
+	}
+	// counter states of the axiom outside the alphabet, such as S3 when only
+	// S1 is a variable, are registered so that they count down
+	for _, module := range l.AxiomModules() {
+		if _, exists := l.TokenBytes[module.Token]; exists {
+			continue
+		}
+		if isVariable(module.Token) {
+			registerVariable(module.Token)
+		} else {
+			l.registerToken(module.Token, false)
+		}
 	}
 	l.EmptyTokenId = l.TokenBytes[""]
 
-	j := 0
-	for baseVar, maxState := range statefulVarParams {
+	bases := make(TokenSet, len(statefulVarParams))
+	for baseVar := range statefulVarParams {
+		bases.Add(baseVar)
+	}
+	for _, baseVar := range bases.Sorted() {
 		minIndex := 1
-		maxIndex := int(maxState)
-		baseTokenId := l.TokenBytes[Token(baseVar)]
+		maxIndex := int(statefulVarParams[baseVar])
+		baseTokenId, hasBase := l.TokenBytes[baseVar]
 		for k := minIndex; k <= maxIndex; k++ {
-			bytePair := NewTokenStateId(uint8(j), true)
-			l.TokenBytes[Token(string(baseVar)+strconv.Itoa(k))] = bytePair
-			l.BytesToken[bytePair] = Token(string(baseVar) + strconv.Itoa(k))
-			l.ParamToByte[bytePair] = baseTokenId
-			l.Params[j] = uint8(k)
-			j++
+			bytePair := l.registerToken(Token(string(baseVar)+strconv.Itoa(k)), true)
+			if !hasBase {
+				baseTokenId = bytePair
+			}
+			l.ParamToByte[bytePair.TokenId()] = baseTokenId
+			l.Params[bytePair.TokenId()] = uint8(k)
 		}
 	}
+	l.indexTokens()
 
-	l.ByteRules = [255]ByteProductionRule{}
+	l.ByteRules = make([]ByteProductionRule, len(l.BytesToken))
 	for t, rule := range l.Rules {
-		l.ByteRules[l.TokenBytes[t]] = rule.EncodeTokens(l.TokenBytes, l.useWeightPreSampling)
+		encoded := rule.EncodeTokens(l.TokenBytes, l.useWeightPreSampling, l.ruleRand(t))
+		l.ByteRules[l.TokenBytes[t].TokenId()] = encoded
+		l.parametric = l.parametric || encoded.Parametric
+	}
+
+	l.axiomIds, l.axiomArgs = nil, nil
+	for _, module := range l.AxiomModules() {
+		l.axiomIds = append(l.axiomIds, l.TokenBytes[module.Token])
+		l.axiomArgs = append(l.axiomArgs, module.Args)
+		l.parametric = l.parametric || module.Args != nil
+	}
+}
+
+// indexTokens looks up the tokens that iteration treats specially.
+func (l *LSystem) indexTokens() {
+	l.branchStart, l.branchEnd = noToken, noToken
+	if id, exists := l.TokenBytes["["]; exists {
+		l.branchStart = id
+	}
+	if id, exists := l.TokenBytes["]"]; exists {
+		l.branchEnd = id
+	}
+	l.contextIgnored = make([]bool, len(l.BytesToken))
+	for _, t := range l.contextIgnore {
+		if id, exists := l.TokenBytes[t]; exists {
+			l.contextIgnored[id.TokenId()] = true
+		}
+	}
+}
+
+// AxiomModules splits the axiom, a whitespace separated sequence of modules
+// such as "F [ n L ] u S3" or "A(1, 2) B", into its modules. The arguments of
+// a module stop at the first one that is not a constant expression, see
+// ValidateAxiom.
+func (l *LSystem) AxiomModules() []Module {
+	modules, _, _ := parseAxiom(l.Axiom)
+	return modules
+}
+
+// parseAxiom splits axiom into its modules and their fields. errs holds for
+// every module why it is malformed, or nil.
+func parseAxiom(axiom Token) (modules []Module, fields []field, errs []error) {
+	fields = splitFields(string(axiom), 0)
+	modules = make([]Module, len(fields))
+	errs = make([]error, len(fields))
+	for i, f := range fields {
+		name, args, ok := splitModule(f.text)
+		modules[i].Token = Token(name)
+		if !ok {
+			errs[i] = ErrMalformedExpression
+			continue
+		}
+		for _, arg := range args {
+			expression, err := CompileExpression(arg, nil)
+			if err != nil {
+				errs[i] = err
+				break
+			}
+			modules[i].Args = append(modules[i].Args, expression.Eval(nil))
+		}
+	}
+	return modules, fields, errs
+}
+
+// ValidateAxiom reports every module of axiom that is malformed or whose
+// token is neither in vars nor in consts. Counter states are accepted when
+// another state of the same counter is a variable.
+func ValidateAxiom(axiom Token, vars, consts TokenSet) error {
+	var diagnostics ParseErrors
+	modules, fields, errs := parseAxiom(axiom)
+	if len(modules) == 0 {
+		return ParseErrors{{Rule: axiom, Group: -1, Line: 1, Column: 1, Err: ErrEmptySuccessor}}
+	}
+	for i, module := range modules {
+		err := errs[i]
+		if err == nil && !vars.Contains(module.Token) && !consts.Contains(module.Token) && !knownCounterState(module.Token, vars) {
+			err = ErrUnknownToken
+		}
+		if err != nil {
+			diagnostics = append(diagnostics, &ParseError{Rule: axiom, Group: -1, Line: 1, Column: fields[i].offset + 1, Text: fields[i].text, Err: err})
+		}
+	}
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+	return nil
+}
+
+func (l *LSystem) registerToken(t Token, hasParam bool) TokenStateId {
+	bytePair := NewTokenStateId(uint32(len(l.BytesToken)), hasParam)
+	l.TokenBytes[t] = bytePair
+	l.BytesToken = append(l.BytesToken, t)
+	l.ParamToByte = append(l.ParamToByte, bytePair)
+	l.Params = append(l.Params, 0)
+	return bytePair
+}
+
+// IdWidth returns the number of bits (8, 16 or 32) needed to store any
+// TokenStateId of this system, see AppendPackedIds.
+func (l *LSystem) IdWidth() int {
+	return idWidth(len(l.BytesToken))
+}
+
+func (l *LSystem) Seed() uint64 {
+	return l.seed
+}
+
+// Generation returns the number of the current generation, 0 for the axiom.
+func (l *LSystem) Generation() int {
+	return l.generation
+}
+
+// SetSeed replaces the seed used by subsequent iterations and pre-samples the
+// rule weights again.
+func (l *LSystem) SetSeed(seed uint64) {
+	l.seed = seed
+	if !l.useWeightPreSampling {
+		return
+	}
+	for t := range l.Rules {
+		l.ByteRules[l.TokenBytes[t].TokenId()].PreSample(l.ruleRand(t))
 	}
 }
 
@@ -115,14 +337,7 @@ func (l *LSystem) EncodeTokens(tokens []Token) []TokenStateId {
 func (l *LSystem) DecodeBytes(bp []TokenStateId) []Token {
 	result := make([]Token, 0, len(bp))
 	for _, bytePair := range bp {
-		//v, exists := l.BytesToken[bytePair]
-		v := l.BytesToken[bytePair]
-		exists := v != ""
-		if !exists {
-			base := bytePair.TokenId()
-			v = l.BytesToken[NewTokenStateId(base, false)]
-		}
-		result = append(result, v)
+		result = append(result, l.BytesToken[bytePair.TokenId()])
 	}
 	return result
 }
@@ -135,100 +350,289 @@ func (l *LSystem) IsConstant(t Token) bool {
 	return l.Constants.Contains(t)
 }
 
-func (l *LSystem) applyRules(n int) {
+// minChunkSize is the smallest number of tokens worth handing to a worker.
+const minChunkSize = 4096
+
+// applyRules derives n generations. When it is aborted the last complete
+// generation stays current.
+func (l *LSystem) applyRules(ctx context.Context, n int) error {
+	for j := 0; j < n; j++ {
+		gen := l.view()
+		lim := l.newLimiter(ctx)
+		l.startTrace(gen)
+		chunks := min(l.MemPool.Chunks(), gen.len/minChunkSize)
+		// the context may be done or the previous generation too large already
+		if lim.add(0) {
+			if chunks <= 1 || l.workers == 1 {
+				l.applyRulesOnce(gen, 0, gen.len, l.MemPool.GetWriteBuffer(0), lim)
+			} else {
+				l.applyRulesParallel(gen, chunks, lim)
+			}
+		}
+		if err := l.finishGeneration(lim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishGeneration makes the generation written current, or discards it when
+// lim stopped it.
+func (l *LSystem) finishGeneration(lim *limiter) error {
+	tracing := l.tracing
+	l.tracing = nil
+	if err := lim.err(); err != nil {
+		for i := 0; i < l.MemPool.Chunks(); i++ {
+			l.MemPool.GetWriteBuffer(i).Clear()
+		}
+		return err
+	}
+	if tracing != nil {
+		l.trace = append(l.trace, tracing)
+	}
+	l.MemPool.SwapAll()
+	l.generation++
+	return nil
+}
+
+// applyRulesParallel splits the generation into chunks of equal length no
+// matter how the previous generation was split. Workers take the next chunk
+// as soon as they are done with one, so a worker stuck with a chunk that
+// explodes does not hold up the others.
+func (l *LSystem) applyRulesParallel(gen *generationView, chunks int, lim *limiter) {
+	var next atomic.Int32
 	var wg sync.WaitGroup
-	for i := 0; i < threadCount; i++ {
+	for w := 0; w < min(l.workers, chunks); w++ {
 		wg.Add(1)
-		go func(i int) {
+		go func() {
 			defer wg.Done()
 
-			for j := 0; j < n; j++ {
-				l.applyRulesOnce(l.MemPool.GetReadBuffer(i), l.MemPool.GetWriteBuffer(i))
-				l.MemPool.Swap(i)
+			for i := int(next.Add(1)) - 1; i < chunks; i = int(next.Add(1)) - 1 {
+				from, to := gen.len*i/chunks, gen.len*(i+1)/chunks
+				if !l.applyRulesOnce(gen, from, to, l.MemPool.GetWriteBuffer(i), lim) {
+					return
+				}
 			}
-		}(i)
+		}()
 	}
-
 	wg.Wait()
 }
 
-func (l *LSystem) applyRulesOnce(input, output *Buffer) {
-	for tokenIdx, token := range input.BytePairs[:input.Len] {
-		if token.HasParam() && l.Params[token.TokenId()] > 1 {
-			token--
+// applyRulesOnce rewrites the tokens of the generation in [from, to) into
+// output. It returns false when lim stopped it.
+func (l *LSystem) applyRulesOnce(gen *generationView, from, to int, output *Buffer, lim *limiter) bool {
+	for chunk := gen.chunk(from); from < to; chunk++ {
+		input, offset := gen.buffers[chunk], gen.offsets[chunk]
+		end := min(to-offset, input.Len)
+		var ok bool
+		if l.parametric {
+			ok = l.applyParametricRulesRange(gen, input, offset, from-offset, end, output, lim)
+		} else {
+			ok = l.applyRulesRange(gen, input, offset, from-offset, end, output, lim)
 		}
-		rules := l.ByteRules[token]
-		if rules.Weights == nil {
-			output.Append(token)
-			continue
+		if !ok {
+			return false
 		}
+		from = offset + end
+	}
+	return true
+}
 
-		predecessor := l.EmptyTokenId
-		if tokenIdx > 0 {
-			predecessor = input.BytePairs[tokenIdx-1]
-		}
-		output.AppendSlice(rules.ChooseSuccessor(l, predecessor))
-		l.ByteRules[token] = rules
+// applyRulesRange rewrites the tokens input holds in [start, end), offset is
+// the index of its first token in the generation. It picks the loop for the
+// id width once, as input and output belong to the same pool.
+func (l *LSystem) applyRulesRange(gen *generationView, input *Buffer, offset, start, end int, output *Buffer, lim *limiter) bool {
+	switch input.width {
+	case 8:
+		return rewriteRange(l, gen, input.ids8, offset, start, end, output, &output.ids8, lim)
+	case 16:
+		return rewriteRange(l, gen, input.ids16, offset, start, end, output, &output.ids16, lim)
 	}
+	return rewriteRange(l, gen, input.ids32, offset, start, end, output, &output.ids32, lim)
 }
 
-func (l *LSystem) IterateUntil(n int) []TokenStateId {
-	l.Reset()
-	if n >= 15 {
-		n -= 10
-		l.prime(10)
-		l.applyRules(n)
-	} else {
-		for i := 0; i < n; i++ {
-			l.applyRulesOnce(l.MemPool.GetReadBuffer(0), l.MemPool.GetWriteBuffer(0))
-			l.MemPool.Swap(0)
+// rewriteRange is applyRulesRange for buffers storing ids as W.
+func rewriteRange[W idWord](l *LSystem, gen *generationView, input []W, offset, start, end int, output *Buffer, out *[]W, lim *limiter) bool {
+	seed := generationSeed(l.seed, l.generation)
+	reported := output.Len
+	for tokenIdx := start; tokenIdx < end; tokenIdx++ {
+		if lim != nil && (tokenIdx-start)%checkInterval == checkInterval-1 {
+			if !lim.add(output.Len - reported) {
+				return false
+			}
+			reported = output.Len
+		}
+		token := unpackWord(input[tokenIdx])
+		if token.HasParam() && l.Params[token.TokenId()] > 1 {
+			token--
+		}
+		rules := &l.ByteRules[token.TokenId()]
+		alt, blocked, produced := -1, false, output.Len
+		if rules.Weights != nil {
+			predecessor := predecessorAt(l, gen, input, offset, tokenIdx)
+			random := positionSample(seed, offset+tokenIdx)
+			if rules.Contextual {
+				alt, blocked, _ = rules.chooseAlternative(l, gen, offset+tokenIdx, predecessor, random, nil)
+			} else {
+				alt, blocked = rules.chooseIndex(l, predecessor, random)
+			}
+		}
+		if alt >= 0 && !blocked {
+			appendWords(output, out, rules.Weights[alt].Successor)
+		} else {
+			appendWord(output, out, token)
+		}
+		if l.counters != nil {
+			l.counters.add(token, alt, blocked)
+		}
+		if l.tracing != nil {
+			l.tracing[offset+tokenIdx] = Derivation{Token: unpackWord(input[tokenIdx]), Alternative: int32(alt), Blocked: blocked, Successors: int32(output.Len - produced)}
 		}
 	}
-	return l.MemPool.ReadAll()
+	return lim.add(output.Len - reported)
 }
 
-func (l *LSystem) prime(n int) {
-	for i := 0; i < n; i++ {
-		l.applyRulesOnce(l.MemPool.GetReadBuffer(0), l.MemPool.GetWriteBuffer(0))
-		l.MemPool.Swap(0)
+// predecessorAt returns the token before ids[tokenIdx], for the first token of
+// a buffer at offset the last token of the previous buffer.
+func predecessorAt[W idWord](l *LSystem, gen *generationView, ids []W, offset, tokenIdx int) TokenStateId {
+	if tokenIdx > 0 {
+		return unpackWord(ids[tokenIdx-1])
 	}
+	return gen.previous(offset, l.EmptyTokenId)
+}
 
-	l.distribute()
+// applyParametricRulesRange is applyRulesRange for systems with parametric
+// modules, evaluating conditions and successor arguments.
+func (l *LSystem) applyParametricRulesRange(gen *generationView, input *Buffer, offset, start, end int, output *Buffer, lim *limiter) bool {
+	switch input.width {
+	case 8:
+		return rewriteParametricRange(l, gen, input, input.ids8, offset, start, end, output, &output.ids8, lim)
+	case 16:
+		return rewriteParametricRange(l, gen, input, input.ids16, offset, start, end, output, &output.ids16, lim)
+	}
+	return rewriteParametricRange(l, gen, input, input.ids32, offset, start, end, output, &output.ids32, lim)
 }
 
-func (l *LSystem) distribute() {
-	chunkSize := l.MemPool.GetReadBuffer(0).Len / threadCount
-	for i := 0; i < threadCount; i++ {
-		// TODO: account for catalysts
-		from := i * chunkSize
-		to := from + chunkSize
-		if i == threadCount-1 {
-			to = l.MemPool.GetReadBuffer(0).Len
+// rewriteParametricRange is applyParametricRulesRange for buffers storing ids
+// as W, ids being the storage of input.
+func rewriteParametricRange[W idWord](l *LSystem, gen *generationView, input *Buffer, ids []W, offset, start, end int, output *Buffer, out *[]W, lim *limiter) bool {
+	seed := generationSeed(l.seed, l.generation)
+	env := make([]float64, 0, 8)
+	var values []float64
+
+	reported := output.Len
+	for tokenIdx := start; tokenIdx < end; tokenIdx++ {
+		if lim != nil && (tokenIdx-start)%checkInterval == checkInterval-1 {
+			if !lim.add(output.Len - reported) {
+				return false
+			}
+			reported = output.Len
+		}
+		token := unpackWord(ids[tokenIdx])
+		args := input.ModuleArgs(tokenIdx)
+		if token.HasParam() && l.Params[token.TokenId()] > 1 {
+			token--
+		}
+		rules := &l.ByteRules[token.TokenId()]
+		alt, blocked, produced := -1, false, output.Len
+		if rules.Weights != nil {
+			predecessor := predecessorAt(l, gen, ids, offset, tokenIdx)
+			alt, blocked, env = rules.chooseAlternative(l, gen, offset+tokenIdx, predecessor, positionSample(seed, offset+tokenIdx), env)
+		}
+
+		if alt < 0 || blocked {
+			appendWord(output, out, token)
+			output.Args = append(output.Args, args...)
+		} else {
+			wt := &rules.Weights[alt]
+			for k, successor := range wt.Successor {
+				values = values[:0]
+				if wt.Arguments != nil {
+					for _, arg := range wt.Arguments[k] {
+						values = append(values, arg.Eval(env))
+					}
+				}
+				appendWord(output, out, successor)
+				output.Args = append(output.Args, values...)
+			}
 		}
+		if l.counters != nil {
+			l.counters.add(token, alt, blocked)
+		}
+		if l.tracing != nil {
+			l.tracing[offset+tokenIdx] = Derivation{Token: unpackWord(ids[tokenIdx]), Alternative: int32(alt), Blocked: blocked, Successors: int32(output.Len - produced)}
+		}
+	}
+	return lim.add(output.Len - reported)
+}
 
-		l.MemPool.GetWriteBuffer(i).AppendSlice(l.MemPool.GetReadBuffer(0).BytePairs[from:to])
+func (l *LSystem) applyRulesSequential(ctx context.Context) error {
+	gen := l.view()
+	lim := l.newLimiter(ctx)
+	l.startTrace(gen)
+	if lim.add(0) {
+		l.applyRulesOnce(gen, 0, gen.len, l.MemPool.GetWriteBuffer(0), lim)
 	}
-	for i := 0; i < threadCount; i++ {
-		l.MemPool.Swap(i)
+	return l.finishGeneration(lim)
+}
+
+// IterateUntil derives generation n from the axiom. It stops silently at the
+// limits set with WithMaxTokens and WithMaxMemory, IterateUntilContext
+// reports them.
+func (l *LSystem) IterateUntil(n int) []TokenStateId {
+	l.IterateUntilContext(context.Background(), n)
+	return l.MemPool.ReadAll()
+}
+
+// IterateUntilContext is IterateUntil returning an *AbortError when ctx is
+// done or a limit is exceeded, in which case the last complete generation
+// stays current.
+func (l *LSystem) IterateUntilContext(ctx context.Context, n int) error {
+	l.Reset()
+	return l.applyRules(ctx, n)
+}
+
+// IterateUntilSeeded is IterateUntil with the seed replaced by seed for this
+// call only: the seed and the pre-sampled weights are restored afterwards.
+func (l *LSystem) IterateUntilSeeded(n int, seed uint64) []TokenStateId {
+	previous := l.seed
+	preSampled := make([][]uint16, len(l.ByteRules))
+	for i := range l.ByteRules {
+		preSampled[i] = append([]uint16(nil), l.ByteRules[i].PreSampledWeights...)
 	}
+	defer func() {
+		l.seed = previous
+		for i, weights := range preSampled {
+			copy(l.ByteRules[i].PreSampledWeights, weights)
+		}
+	}()
+
+	l.SetSeed(seed)
+	return l.IterateUntil(n)
 }
 
 func (l *LSystem) Iterate(n int) []TokenStateId {
-	l.applyRules(n)
+	l.applyRules(context.Background(), n)
 
 	return l.MemPool.ReadAll()
 }
 
+// IterateContext derives n more generations, see IterateUntilContext.
+func (l *LSystem) IterateContext(ctx context.Context, n int) error {
+	return l.applyRules(ctx, n)
+}
+
+// IterateOnce derives the next generation and returns its tokens, which stay
+// valid until the next iteration.
 func (l *LSystem) IterateOnce() []TokenStateId {
-	l.applyRulesOnce(l.MemPool.GetReadBuffer(0), l.MemPool.GetWriteBuffer(0))
-	l.MemPool.Swap(0)
+	l.applyRulesSequential(context.Background())
 
-	buffer := l.MemPool.GetReadBuffer(0)
-	return buffer.BytePairs[:buffer.Len]
+	return l.MemPool.readView(0)
 }
 
 func (l *LSystem) String() string {
 	var sb strings.Builder
+	sb.WriteString("axiom: " + string(l.Axiom) + "\n")
 	for tokenId, rule := range l.ByteRules {
 		if rule.Weights == nil {
 			continue
@@ -241,13 +645,72 @@ func (l *LSystem) String() string {
 }
 
 func (l *LSystem) Reset() {
+	l.generation = 0
+	l.trace = nil
+	if l.countRules {
+		l.counters = newRuleCounters(l.ByteRules)
+	}
 	l.MemPool.Reset()
-	l.MemPool.GetReadBuffer(0).Append(l.TokenBytes[l.Axiom])
-	l.MemPool.GetReadBuffer(0).Len = 1
+	for i, id := range l.axiomIds {
+		l.MemPool.GetReadBuffer(0).AppendModule(id, l.axiomArgs[i])
+	}
+}
+
+// Len returns the number of tokens in the current generation.
+func (l *LSystem) Len() int {
+	return l.view().len
 }
 
+// Walk calls fn for every current token and its arguments, in order, without
+// decoding them. It stops early and returns false when fn returns false.
+func (l *LSystem) Walk(fn func(t TokenStateId, args []float64) bool) bool {
+	for i := 0; i < l.MemPool.Chunks(); i++ {
+		buf := l.MemPool.GetReadBuffer(i)
+		for j := 0; j < buf.Len; j++ {
+			if !fn(buf.At(j), buf.ModuleArgs(j)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ReadModules returns the current tokens together with their parameters.
+func (l *LSystem) ReadModules() []Module {
+	var modules []Module
+	for i := 0; i < l.MemPool.Chunks(); i++ {
+		buf := l.MemPool.GetReadBuffer(i)
+		for j := 0; j < buf.Len; j++ {
+			id := buf.At(j)
+			modules = append(modules, Module{
+				Token: l.BytesToken[id.TokenId()],
+				Args:  append([]float64(nil), buf.ModuleArgs(j)...),
+			})
+		}
+	}
+	return modules
+}
+
+// ProductionRate holds the growth ratios sampled by AnalyseProductionRates
+// together with a histogram of them, Rates[i] counting the ratios closest to
+// i/1000.
 type ProductionRate struct {
-	Token Token
-	Rates []float32
-	Rule  fmt.Stringer
+	Token  Token
+	Rates  []float32
+	Rule   fmt.Stringer
+	Ratios []float64
+	Stats  GrowthStats
+}
+
+func knownCounterState(t Token, vars TokenSet) bool {
+	base, _, ok := tryParseStatefulVariable(t)
+	if !ok {
+		return false
+	}
+	for v := range vars {
+		if other, _, ok := tryParseStatefulVariable(v); ok && other == base {
+			return true
+		}
+	}
+	return false
 }
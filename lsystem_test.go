@@ -1,8 +1,20 @@
 package lsystem
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"pgregory.net/rand"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var benchmarkRules = map[Token]string{
@@ -72,12 +84,28 @@ func BenchmarkLSystemIterate(b *testing.B) {
 	}
 }
 
+// BenchmarkLSystemWorkers iterates the skewed benchmark rules, where most of
+// the growth happens in a few L branches, with an increasing number of workers.
+func BenchmarkLSystemWorkers(b *testing.B) {
+	vars, consts, rules := ParseRules(benchmarkRules)
+	for _, workers := range []int{1, 2, 4, 8} {
+		ls := NewLSystem("Seed", rules, vars, consts, true, WithSeed(1), WithWorkers(workers))
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ls.IterateUntil(400)
+			}
+		})
+	}
+}
+
 func BenchmarkChooseSuccessor(b *testing.B) {
 	r := NewProductionRule("L", ParseRule(`0.1 L u L w F e; 0.1 L_ u L e F w; 0.1 L_ u L n F s; 0.1 L_ u L s F n; 0.04 L_ [ w L_ w u seed ]; 0.04 L_ [ e L_ e u seed ]; 0.04 L_ [ s L_ s u seed ]; 0.04 L_ [ n L_ n u seed ]; 0.05 L_ u L; 1 L`))
 
+	rng := rand.New(1)
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		r.ChooseSuccessor()
+		r.ChooseSuccessor(rng)
 	}
 }
 
@@ -86,11 +114,11 @@ func BenchmarkChooseSuccessorBytes(b *testing.B) {
 	ls := NewLSystem("Seed", rules, vars, consts, true)
 	r := NewProductionRule("L", ParseRule(`0.1 L u L w F e; 0.1 L_ u L e F w; 0.1 L_ u L n F s; 0.1 L_ u L s F n; 0.04 L_ [ w L_ w u seed ]; 0.04 L_ [ e L_ e u seed ]; 0.04 L_ [ s L_ s u seed ]; 0.04 L_ [ n L_ n u seed ]; 0.05 L_ u L; 1 L`))
 
-	br := ls.ByteRules[ls.TokenBytes[r.Predecessor]]
+	br := ls.ByteRules[ls.TokenBytes[r.Predecessor].TokenId()]
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		br.ChooseSuccessor(ls, ls.EmptyTokenId)
+		br.ChooseSuccessor(ls, ls.EmptyTokenId, uint64(i))
 	}
 }
 
@@ -126,6 +154,13 @@ func TestCounterVariables(t *testing.T) {
 
 	ls.IterateOnce()
 	assertState(t, []Token{"L", "u", "X"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+
+	// S3 is a variable and a counter state, with a single id
+	assert.True(t, vars.Contains("S3"))
+	assert.Len(t, ls.BytesToken, len(ls.TokenBytes))
+	for i, token := range ls.BytesToken {
+		assert.Equal(t, uint32(i), ls.TokenBytes[token].TokenId(), token)
+	}
 }
 
 func TestCatalystParse(t *testing.T) {
@@ -134,7 +169,7 @@ func TestCatalystParse(t *testing.T) {
 		"B": `1 *B A A`,
 	}
 	vars, consts, rules := ParseRules(catalystRules)
-	ls := NewLSystem("Seed", rules, vars, consts, false)
+	ls := NewLSystem("A", rules, vars, consts, false)
 
 	ls.IterateOnce()
 	assertState(t, []Token{"A", "B"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
@@ -146,7 +181,1014 @@ func TestCatalystParse(t *testing.T) {
 	assertState(t, []Token{"A", "B", "B", "A", "A", "A", "B", "A", "B"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
 }
 
+func TestLargeAlphabet(t *testing.T) {
+	rulesStr := map[Token]string{"A": "1 A"}
+	for i := 0; i < 300; i++ {
+		rulesStr["A"] += " a" + strconv.Itoa(i)
+		rulesStr[Token("C"+strconv.Itoa(i))] = "1 c" + strconv.Itoa(i)
+	}
+	vars, consts, rules := ParseRules(rulesStr)
+	ls := NewLSystem("A", rules, vars, consts, false)
+	assert.Equal(t, 16, ls.IdWidth())
+	assert.Equal(t, 16, ls.MemPool.IdWidth())
+
+	state := ls.DecodeBytes(ls.IterateOnce())
+	assert.Len(t, state, 301)
+	assert.Equal(t, Token("a299"), state[300])
+
+	packed, err := AppendPackedIds(nil, ls.MemPool.ReadAll(), ls.IdWidth())
+	assert.NoError(t, err)
+	assert.Len(t, packed, 602)
+	assert.Equal(t, ls.MemPool.ReadAll(), UnpackIds(packed, ls.IdWidth()))
+
+	_, err = AppendPackedIds(nil, ls.MemPool.ReadAll(), 8)
+	assert.ErrorIs(t, err, ErrIdWidth)
+
+	// small alphabets take a byte per token, counter flags included
+	vars, consts, rules = ParseRules(map[Token]string{"Seed": `1 A S3`, "S1": `1 A`, "A": `1 A`})
+	small := NewLSystem("Seed", rules, vars, consts, false)
+	assert.Equal(t, 8, small.MemPool.IdWidth())
+	wide := small.RecreateWithMemPool(small.ByteRules, NewMemPool(32))
+	assert.Equal(t, 32, wide.MemPool.IdWidth())
+	assert.Equal(t, 4*small.MemPool.Bytes(), wide.MemPool.Bytes())
+	assertState(t, []Token{"A", "S2"}, small.DecodeBytes(small.IterateUntil(2)))
+	assert.Equal(t, small.IterateUntil(4), wide.IterateUntil(4))
+	assertState(t, []Token{"A", "A"}, small.DecodeBytes(small.MemPool.ReadAll()))
+	assertState(t, []Token{"A", "A"}, small.DecodeBytes(small.IterateOnce()))
+
+	ids := []TokenStateId{NewTokenStateId(0, false), NewTokenStateId(5, true), NewTokenStateId(127, true)}
+	for _, width := range []int{8, 16, 32} {
+		buf := newBuffer(1, width)
+		buf.AppendSlice(ids)
+		buf.Append(ids[1])
+		assert.Equal(t, []TokenStateId{ids[0], ids[1], ids[2], ids[1]}, buf.AppendIds(nil, 0, buf.Len))
+		assert.Equal(t, ids[2], buf.At(2))
+		assert.Equal(t, []TokenStateId{ids[0], ids[1], ids[2], ids[1]}, buf.BytePairs())
+	}
+}
+
+func TestSeededIterations(t *testing.T) {
+	for _, presample := range []bool{false, true} {
+		vars, consts, rules := ParseRules(benchmarkRules)
+		parallel := NewLSystem("Seed", rules, vars, consts, presample, WithSeed(42))
+		sequential := NewLSystem("Seed", rules, vars, consts, presample, WithSeed(42))
+
+		expected := parallel.DecodeBytes(parallel.IterateUntil(40))
+		sequential.Reset()
+		for i := 0; i < 40; i++ {
+			sequential.IterateOnce()
+		}
+		assertState(t, expected, sequential.DecodeBytes(sequential.MemPool.ReadAll()))
+		assertState(t, expected, parallel.DecodeBytes(parallel.IterateUntil(40)))
+
+		other := parallel.DecodeBytes(parallel.IterateUntilSeeded(40, 43))
+		assert.NotEqual(t, expected, other)
+		assertState(t, expected, parallel.DecodeBytes(parallel.IterateUntilSeeded(40, 42)))
+
+		// the override only holds for the call
+		assert.NotEqual(t, expected, parallel.DecodeBytes(parallel.IterateUntilSeeded(40, 43)))
+		assert.Equal(t, uint64(42), parallel.Seed())
+		assertState(t, expected, parallel.DecodeBytes(parallel.IterateUntil(40)))
+
+		// a rule weighing nothing keeps the token either way
+		vars, consts, rules = ParseRules(map[Token]string{"A": "0 B"})
+		zero := NewLSystem("A", rules, vars, consts, presample)
+		assert.Nil(t, zero.ByteRules[zero.TokenBytes["A"].TokenId()].PreSampledWeights)
+		assertState(t, []Token{"A"}, zero.DecodeBytes(zero.IterateOnce()))
+	}
+}
+
+func TestContextSensitiveRules(t *testing.T) {
+	var contextRules = map[Token]string{
+		"S":      `1 B [ A ] [ + A ] A`,
+		"B < A":  `1 B`,
+		"B":      `1 A`,
+		"A > C":  `1 D`,
+		"A A <C": `1 E`,
+	}
+	vars, consts, rules, warnings, err := ParseRulesWithOptions(contextRules, ParseOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.ErrorIs(t, warnings[0], ErrMalformedContext)
+	assert.Len(t, rules["A"].Weights, 2)
+
+	ls := NewLSystem("S", rules, vars, consts, false, WithContextIgnore("+"))
+	ls.IterateOnce()
+	assertState(t, []Token{"B", "[", "A", "]", "[", "+", "A", "]", "A"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+	ls.IterateOnce()
+	assertState(t, []Token{"A", "[", "B", "]", "[", "+", "B", "]", "B"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+
+	contextRules = map[Token]string{
+		"S":         `1 A A C`,
+		"A A < C":   `1 E`,
+		"A < A > C": `1 F`,
+	}
+	vars, consts, rules = ParseRules(contextRules)
+	ls = NewLSystem("S", rules, vars, consts, false)
+	ls.IterateOnce()
+	ls.IterateOnce()
+	assertState(t, []Token{"A", "F", "E"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+}
+
+func TestParametricRules(t *testing.T) {
+	var parametricRules = map[Token]string{
+		"A(t) : t > 2":         `1 F(t * 0.5) [ +(25) A(t-1) ] A(t-1)`,
+		"A(t) : t <= 2":        `1 X(t)`,
+		"F(l)":                 `1 F(l+1)`,
+		"F(l) < X(y) : y == 2": `1 X(l+y) C`,
+		"C":                    `0.5 *X C(1); 0.5 *X C(-1)`,
+	}
+	vars, consts, rules, warnings, err := ParseRulesWithOptions(parametricRules, ParseOptions{Strict: true})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	ls := NewLSystem("A(3)", rules, vars, consts, false, WithContextIgnore("+"))
+	ls.IterateOnce()
+	assert.Equal(t, "F(1.5) [ +(25) A(2) ] A(2)", modulesString(ls.ReadModules()))
+	ls.IterateOnce()
+	assert.Equal(t, "F(2.5) [ +(25) X(2) ] X(2)", modulesString(ls.ReadModules()))
+	ls.IterateOnce()
+	assert.Equal(t, "F(3.5) [ +(25) X(4.5) C ] X(4.5) C", modulesString(ls.ReadModules()))
+	ls.IterateOnce()
+	assert.Regexp(t, `^F\(4\.5\) \[ \+\(25\) X\(4\.5\) C\(-?1\) \] X\(4\.5\) C\(-?1\)$`, modulesString(ls.ReadModules()))
+
+	_, _, err = ParseRuleWithOptions("A(t)", "1 F(q)", ParseOptions{Strict: true})
+	assert.ErrorIs(t, err, ErrMalformedExpression)
+	_, _, err = ParseRuleWithOptions("A(t) : t >", "1 F(t)", ParseOptions{Strict: true})
+	assert.ErrorIs(t, err, ErrMalformedExpression)
+
+	// rules without conditions keep their pre-sampled choices
+	vars, consts, rules = ParseRules(map[Token]string{
+		"A(t)":         `0.5 A(t+1); 0.5 B(t)`,
+		"B(t) : t > 0": `1 B(t-1)`,
+	})
+	presampled := NewLSystem("A(2)", rules, vars, consts, true)
+	a, b := &presampled.ByteRules[presampled.TokenBytes["A"].TokenId()], &presampled.ByteRules[presampled.TokenBytes["B"].TokenId()]
+	assert.NotNil(t, a.PreSampledWeights)
+	assert.Nil(t, b.PreSampledWeights)
+	for i := range a.PreSampledWeights {
+		a.PreSampledWeights[i] = 1
+	}
+	presampled.Iterate(2)
+	assert.Equal(t, "B(1)", modulesString(presampled.ReadModules()))
+
+	// the limits of the binary formats hold for everything parsed
+	_, err = CompileExpression(strings.Repeat("1+", maxExprDepth)+"1", nil)
+	assert.NoError(t, err)
+	_, err = CompileExpression(strings.Repeat("-", maxExprDepth+1)+"1", nil)
+	assert.ErrorIs(t, err, ErrMalformedExpression)
+	manyArgs := "F(" + strings.Repeat("1, ", maxModuleArgs) + "1)"
+	_, _, err = ParseRuleWithOptions("A(t)", "1 "+manyArgs, ParseOptions{Strict: true})
+	assert.ErrorIs(t, err, ErrMalformedExpression)
+	_, err = (&TokenStream{Alphabet: []Token{"F"}, Tokens: []TokenStateId{0}, Args: [][]float64{make([]float64, maxModuleArgs+1)}}).WriteTo(io.Discard)
+	assert.ErrorIs(t, err, ErrBinaryFormat)
+}
+
+func TestParametricIterateUntil(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A(t)": `0.5 A(t+1) B(t); 0.5 B(t) A(t*2)`,
+		"B(t)": `1 B(t/2)`,
+	})
+	parallel := NewLSystem("A(1)", rules, vars, consts, false, WithSeed(7))
+	sequential := NewLSystem("A(1)", rules, vars, consts, false, WithSeed(7))
+
+	parallel.IterateUntil(30)
+	for i := 0; i < 30; i++ {
+		sequential.IterateOnce()
+	}
+	assert.Len(t, sequential.ReadModules(), 31)
+	assert.Equal(t, modulesString(sequential.ReadModules()), modulesString(parallel.ReadModules()))
+}
+
+func modulesString(modules []Module) string {
+	parts := make([]string, len(modules))
+	for i, m := range modules {
+		parts[i] = m.String()
+	}
+	return strings.Join(parts, " ")
+}
+
 func assertState(t *testing.T, expected, actual []Token) {
 	assert.Equal(t, len(expected), len(actual))
 	assert.EqualValues(t, expected, actual)
 }
+
+func TestParseRuleDiagnostics(t *testing.T) {
+	weights, warnings, err := ParseRuleWithOptions("F", "0.005 F [ d D ];\n 0.0O8 F [ n F_ ]; 1 *; 1 *C; 1 F *C", ParseOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, weights, 1)
+
+	assert.Len(t, warnings, 4)
+	assert.ErrorIs(t, warnings[0], ErrMalformedWeight)
+	assert.Equal(t, ParseError{Rule: "F", Group: 1, Line: 2, Column: 2, Text: "0.0O8", Err: ErrMalformedWeight}, *warnings[0])
+	assert.ErrorIs(t, warnings[1], ErrDanglingCatalyst)
+	assert.ErrorIs(t, warnings[2], ErrEmptySuccessor)
+	assert.ErrorIs(t, warnings[3], ErrDanglingCatalyst)
+	assert.Equal(t, 35, warnings[3].Column)
+
+	_, _, err = ParseRuleWithOptions("F", "1 F G", ParseOptions{Strict: true, Alphabet: TokenSet{"F": {}}})
+	var diagnostics ParseErrors
+	assert.ErrorAs(t, err, &diagnostics)
+	assert.Len(t, diagnostics, 1)
+	assert.ErrorIs(t, diagnostics[0], ErrUnknownToken)
+	assert.Equal(t, "G", diagnostics[0].Text)
+
+	// the column is that of the module, not of the first match of its name
+	_, _, err = ParseRuleWithOptions("BA < A > B", "1 A", ParseOptions{Strict: true, Alphabet: TokenSet{"BA": {}}})
+	assert.ErrorAs(t, err, &diagnostics)
+	assert.Equal(t, ParseError{Rule: "BA < A > B", Group: -1, Line: 1, Column: 10, Text: "B", Err: ErrUnknownToken}, *diagnostics[0])
+	_, _, err = ParseRuleWithOptions("A(t) : t > q", "1 A(t)", ParseOptions{Strict: true})
+	assert.ErrorAs(t, err, &diagnostics)
+	assert.Equal(t, 8, diagnostics[0].Column)
+}
+
+func TestProductionRuleString(t *testing.T) {
+	keys := map[Token]string{
+		"B(x) < A(t) > C : t > x": `0.25 *B F(t, x) A(t-1); 0.75 A(t)`,
+		"A(t)":                    `1 *C -> F(t)`,
+		"A":                       `1 A B`,
+	}
+	for key, body := range keys {
+		weights, _, err := ParseRuleWithOptions(key, strings.ReplaceAll(body, "-> ", ""), ParseOptions{Strict: true})
+		assert.NoError(t, err)
+		rule := NewProductionRule("A", weights)
+		str := rule.String()
+		assert.True(t, strings.HasPrefix(str, `"A": `+"`"), str)
+
+		// every alternative parses back from its key and successor
+		alternatives := strings.Split(strings.Trim(strings.TrimPrefix(str, `"A": `), "`"), "; ")
+		assert.Len(t, alternatives, len(weights))
+		for i, alternative := range alternatives {
+			group, successor, found := strings.Cut(alternative, " -> ")
+			fields := strings.Fields(group)
+			altKey := Token("A")
+			if found && !strings.HasPrefix(fields[len(fields)-1], "*") {
+				n := 1
+				if strings.HasPrefix(fields[1], "*") {
+					n = 2
+				}
+				altKey = Token(strings.Join(fields[n:], " "))
+				group = strings.Join(fields[:n], " ")
+			}
+			parsed, _, err := ParseRuleWithOptions(altKey, group+" "+successor, ParseOptions{Strict: true})
+			assert.NoError(t, err, alternative)
+			assert.Equal(t, []WeightedRule{weights[i]}, parsed, alternative)
+		}
+	}
+}
+
+func TestParseRulesStrict(t *testing.T) {
+	_, _, _, _, err := ParseRulesWithOptions(benchmarkRules, ParseOptions{Strict: true})
+	assert.Error(t, err)
+
+	_, _, rules, warnings, err := ParseRulesWithOptions(benchmarkRules, ParseOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 4)
+	assert.Len(t, rules["F"].Weights, 3)
+}
+
+func TestGrammarRoundTrip(t *testing.T) {
+	const source = `# catalyst demo
+@axiom S
+@iterations 6
+@seed 7
+@variables A
+@constants _
+@counter C 9
+@hint angle 25
+
+S -> 1 C9 A
+
+# C counts down before A may grow
+A -> 1 *C A A;
+	# then A stops branching
+	1 *C A
+
+C4 -> 1 _
+
+# end of rules
+`
+	g, err := LoadGrammar(strings.NewReader(source))
+	assert.NoError(t, err)
+	assert.Equal(t, Token("S"), g.Axiom)
+	assert.Equal(t, []Counter{{Token: "C", Max: 9}}, g.Counters)
+	assert.Equal(t, []string{"# C counts down before A may grow"}, g.Rules[1].Comments)
+	assert.Equal(t, "1 *C A A;\n# then A stops branching\n1 *C A", g.Rules[1].Body)
+	assert.Equal(t, []string{"# end of rules"}, g.EndComments)
+	angle, _ := g.Hint("angle")
+	assert.Equal(t, "25", angle)
+
+	var sb strings.Builder
+	assert.NoError(t, SaveGrammar(&sb, g))
+	assert.Equal(t, source, sb.String())
+
+	ls, err := g.NewLSystem(false)
+	assert.NoError(t, err)
+	assert.True(t, ls.Variables.Contains("C1"))
+	expected := NewLSystem("S", ls.Rules, ls.Variables, ls.Constants, false, WithSeed(7))
+	assert.Equal(t, expected.DecodeBytes(expected.IterateUntil(6)), ls.DecodeBytes(ls.IterateUntil(g.Iterations)))
+
+	g.Rules[1].Body = "1 *C A A;\n# note\n  x A"
+	g.Rules[1].indents = []int{1, 4}
+	_, err = g.NewLSystem(false)
+	var diagnostics ParseErrors
+	assert.ErrorAs(t, err, &diagnostics)
+	assert.Equal(t, 15, diagnostics[0].Line)
+	assert.Equal(t, 7, diagnostics[0].Column)
+
+	g, err = LoadGrammar(strings.NewReader("@axiom A(1)\nA(t) : t>-1 -> 1 A(t-1)\nB(x->y) -> 1 B\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, Token("A(t) : t>-1"), g.Rules[0].Key)
+	assert.Equal(t, "1 A(t-1)", g.Rules[0].Body)
+	assert.Equal(t, Token("B(x->y)"), g.Rules[1].Key)
+
+	_, err = LoadGrammar(strings.NewReader("@axiom S\nS 1 A\n"))
+	assert.ErrorIs(t, err, ErrMalformedRule)
+	var grammarErr *GrammarError
+	assert.ErrorAs(t, err, &grammarErr)
+	assert.Equal(t, 2, grammarErr.Line)
+
+	long := "S -> 1" + strings.Repeat(" A", 64<<10) + "\n"
+	g, err = LoadGrammar(strings.NewReader("@axiom S\n" + long))
+	assert.NoError(t, err)
+	assert.Len(t, g.Rules[0].Body, len(long)-len("S -> \n"))
+	_, err = LoadGrammar(io.MultiReader(strings.NewReader("@axiom S\n"), strings.NewReader(strings.Repeat("A", maxGrammarLine+1))))
+	assert.ErrorAs(t, err, &grammarErr)
+	assert.Equal(t, 2, grammarErr.Line)
+}
+
+func TestMultiTokenAxiom(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"L":  `1 L F`,
+		"S1": `1 X`,
+		"F":  `1 F`,
+	})
+	ls := NewLSystem("F [ n L ] u S2", rules, vars, consts, false, WithSeed(1))
+	assertState(t, []Token{"F", "[", "n", "L", "]", "u", "S2"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+	ls.IterateOnce()
+	assertState(t, []Token{"F", "[", "n", "L", "F", "]", "u", "X"}, ls.DecodeBytes(ls.MemPool.ReadAll()))
+	assert.True(t, strings.HasPrefix(ls.String(), "axiom: F [ n L ] u S2\n"))
+
+	assert.NoError(t, ValidateAxiom("F [ n L ] u S2", vars, TokenSet{"[": {}, "]": {}, "n": {}, "u": {}}))
+	_, err := NewValidatedLSystem("F q L", rules, vars, consts, false)
+	assert.ErrorIs(t, err, ErrUnknownToken)
+	_, err = NewValidatedLSystem("F L(1+)", rules, vars, consts, false)
+	assert.ErrorIs(t, err, ErrMalformedExpression)
+	unchecked := NewLSystem("F q L", rules, vars, consts, false)
+	assert.Equal(t, 3, unchecked.Len())
+	_, err = unchecked.Report(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrUnknownToken)
+
+	err = ValidateAxiom("F q(1) L(", vars, consts)
+	var diagnostics ParseErrors
+	assert.ErrorAs(t, err, &diagnostics)
+	assert.Len(t, diagnostics, 2)
+	assert.ErrorIs(t, diagnostics[0], ErrUnknownToken)
+	assert.Equal(t, 3, diagnostics[0].Column)
+	assert.ErrorIs(t, diagnostics[1], ErrMalformedExpression)
+}
+
+func TestCatalystsAcrossChunks(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": `1 *B A B; 1 B`,
+		"B": `1 *A A; 1 B A`,
+	})
+	parallel := NewLSystem("A B", rules, vars, consts, false, WithSeed(5), WithWorkers(4))
+	sequential := NewLSystem("A B", rules, vars, consts, false, WithSeed(5), WithWorkers(1))
+
+	expected := parallel.DecodeBytes(parallel.IterateUntil(32))
+	for i := 0; i < 32; i++ {
+		sequential.IterateOnce()
+	}
+	// large enough to be split across all chunks
+	assert.Greater(t, len(expected), 16*minChunkSize)
+	assertState(t, expected, sequential.DecodeBytes(sequential.MemPool.ReadAll()))
+
+	parallel.IterateOnce()
+	sequential.IterateOnce()
+	assertState(t, sequential.DecodeBytes(sequential.MemPool.ReadAll()), parallel.DecodeBytes(parallel.MemPool.ReadAll()))
+}
+
+func TestExpand(t *testing.T) {
+	expand := func(ls *LSystem, n int) []Module {
+		var modules []Module
+		assert.NoError(t, ls.Expand(n, func(id TokenStateId, args []float64) bool {
+			modules = append(modules, Module{Token: ls.BytesToken[id.TokenId()], Args: append([]float64(nil), args...)})
+			return true
+		}))
+		return modules
+	}
+
+	vars, consts, rules := ParseRules(benchmarkRules)
+	ls := NewLSystem("Seed", rules, vars, consts, true, WithSeed(3))
+	expected := ls.DecodeBytes(ls.IterateUntil(60))
+	var actual []Token
+	for _, m := range expand(ls, 60) {
+		actual = append(actual, m.Token)
+	}
+	assertState(t, expected, actual)
+
+	vars, consts, rules = ParseRules(map[Token]string{
+		"A": `1 *B A B; 1 B`,
+		"B": `1 *A A; 1 B A`,
+	})
+	ls = NewLSystem("A B", rules, vars, consts, false, WithSeed(5), WithWorkers(4))
+	var packed bytes.Buffer
+	assert.NoError(t, ls.ExpandTo(&packed, 32))
+	assert.Equal(t, ls.IterateUntil(32), UnpackIds(packed.Bytes(), ls.IdWidth()))
+
+	vars, consts, rules = ParseRules(map[Token]string{
+		"A(l)": `1 F(l) [ A(l*0.5) ] A(l+1)`,
+	})
+	ls = NewLSystem("A(1)", rules, vars, consts, false, WithSeed(1))
+	ls.IterateUntil(6)
+	assert.Equal(t, modulesString(ls.ReadModules()), modulesString(expand(ls, 6)))
+
+	count := 0
+	assert.NoError(t, ls.Expand(6, func(TokenStateId, []float64) bool {
+		count++
+		return count < 5
+	}))
+	assert.Equal(t, 5, count)
+
+	vars, consts, rules = ParseRules(map[Token]string{"A < B": `1 A`})
+	ls = NewLSystem("A B", rules, vars, consts, false)
+	assert.ErrorIs(t, ls.Expand(3, func(TokenStateId, []float64) bool { return true }), ErrContextual)
+}
+
+func TestIterationLimits(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": "1 A B",
+		"B": "1 A",
+	})
+	ls := NewLSystem("A", rules, vars, consts, false, WithMaxTokens(100_000), WithWorkers(4))
+	err := ls.IterateUntilContext(context.Background(), 40)
+	var abort *AbortError
+	assert.ErrorAs(t, err, &abort)
+	assert.ErrorIs(t, err, ErrTokenLimit)
+	// generation 24 is the first holding more than 100000 tokens
+	assert.Equal(t, 24, abort.Generation)
+	assert.Greater(t, abort.Tokens, 100_000)
+	assert.Len(t, ls.MemPool.ReadAll(), 75025)
+
+	err = ls.Expand(30, func(TokenStateId, []float64) bool { return true })
+	assert.ErrorIs(t, err, ErrTokenLimit)
+
+	ls = NewLSystem("A", rules, vars, consts, false, WithMaxMemory(1<<20))
+	assert.ErrorIs(t, ls.IterateUntilContext(context.Background(), 40), ErrMemoryLimit)
+	assert.LessOrEqual(t, ls.MemPool.Bytes(), 2<<20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ls = NewLSystem("A", rules, vars, consts, false)
+	err = ls.IterateUntilContext(ctx, 40)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorAs(t, err, &abort)
+	assert.Equal(t, 1, abort.Generation)
+	assert.ErrorIs(t, ls.ExpandContext(ctx, 30, func(TokenStateId, []float64) bool { return true }), context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, ls.IterateUntilContext(ctx, 100), context.DeadlineExceeded)
+}
+
+func TestTrace(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": `1 A B`,
+		"B": `1 *B A A`,
+	})
+	ls := NewLSystem("A", rules, vars, consts, false, WithTracing())
+	ls.IterateUntil(3)
+	trace := ls.Trace()
+	assert.Equal(t, 3, trace.Depth())
+	assert.Equal(t, 5, trace.Len(3))
+
+	// generation 2 is A B B, the first B is blocked by the A before it
+	assert.Equal(t, TraceNode{Generation: 2, Position: 1, Token: "B", Alternative: 0, Blocked: true}, trace.Node(2, 1))
+	assert.Equal(t, TraceNode{Generation: 2, Position: 2, Token: "B", Alternative: 0}, trace.Node(2, 2))
+	from, to := trace.Children(2, 2)
+	assert.Equal(t, 3, from)
+	assert.Equal(t, 5, to)
+	assert.Equal(t, 2, trace.Parent(3, 4))
+	assert.Equal(t, 1, trace.Parent(3, 2))
+	assert.Equal(t, -1, trace.Parent(0, 0))
+
+	var dot strings.Builder
+	assert.NoError(t, trace.WriteDOT(&dot))
+	assert.True(t, strings.HasPrefix(dot.String(), "digraph derivation {\n"))
+	assert.Contains(t, dot.String(), `n2_1 [label="B" color=red];`)
+	assert.Contains(t, dot.String(), "n2_2 -> n3_4 [label=\"#0\"];\n")
+
+	ls.Reset()
+	assert.Zero(t, ls.Trace().Depth())
+	ls = NewLSystem("A", rules, vars, consts, false)
+	ls.IterateUntil(3)
+	assert.Nil(t, ls.Trace())
+}
+
+func TestAnalyseProductionRates(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": "1 A B",
+		"B": "1 A",
+		"C": "0.5 C C; 0.5 C",
+	})
+	ls := NewLSystem("A", rules, vars, consts, false)
+	rates := ls.AnalyseProductionRates(AnalysisOptions{Runs: 4, Iterations: 10, Samples: 5, Percentiles: []float64{0, 50, 100}})
+	assert.Len(t, rates, 4)
+	assert.Equal(t, 1, ls.Len())
+
+	// A grows by one B in isolation, from 11 to 16 tokens while sampled
+	assert.Equal(t, 20, rates["A"].Stats.Samples)
+	assert.InDelta(t, (12.0/11+13.0/12+14.0/13+15.0/14+16.0/15)/5, rates["A"].Stats.Mean, 1e-9)
+	assert.Equal(t, 1.0, rates["B"].Stats.Mean)
+	assert.Zero(t, rates["B"].Stats.Variance)
+	assert.InDelta(t, 1.618, rates["LSystem"].Stats.Mean, 1e-3)
+	assert.Equal(t, float32(20), rates["B"].Rates[1000])
+
+	c := rates["C"].Stats
+	assert.InDelta(t, 1.5, c.Mean, 0.1)
+	assert.Greater(t, c.Variance, 0.0)
+	assert.Equal(t, []Percentile{{0, c.Min}, {50, c.Percentiles[1].Value}, {100, c.Max}}, c.Percentiles)
+	assert.LessOrEqual(t, c.Min, c.Percentiles[1].Value)
+}
+
+func TestProductionMatrix(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A":  "1 A B",
+		"B":  "1 A",
+		"C":  "0.5 C C; 0.5 C",
+		"S1": "1 X",
+	})
+	ls := NewLSystem("A", rules, vars, consts, false)
+	m := ls.ProductionMatrix()
+	a, b := ls.TokenBytes["A"].TokenId(), ls.TokenBytes["B"].TokenId()
+	counts := m.ExpectedCounts(5)
+	assert.Equal(t, 8.0, counts[a])
+	assert.Equal(t, 5.0, counts[b])
+	assert.Equal(t, len(ls.IterateUntil(5)), int(counts[a]+counts[b]))
+
+	rate, composition := m.Growth()
+	phi := (1 + math.Sqrt(5)) / 2
+	assert.InDelta(t, phi, rate, 1e-9)
+	assert.InDelta(t, 1/phi, composition[a], 1e-9)
+	assert.Empty(t, m.Approximate)
+
+	ls = NewLSystem("C S2", rules, vars, consts, false)
+	m = ls.ProductionMatrix()
+	rate, _ = m.Growth()
+	assert.InDelta(t, 1.5, rate, 1e-9)
+	counts = m.ExpectedCounts(2)
+	assert.Equal(t, 2.25, counts[ls.TokenBytes["C"].TokenId()])
+	assert.Equal(t, 1.0, counts[ls.TokenBytes["X"].TokenId()])
+
+	vars, consts, rules = ParseRules(map[Token]string{
+		"A": "1 A B",
+		"B": "1 *B A A",
+	})
+	m = NewLSystem("A", rules, vars, consts, false).ProductionMatrix()
+	assert.Equal(t, []Token{"B"}, m.Approximate)
+}
+
+func TestCountAt(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A":  "1 A B",
+		"B":  "1 A",
+		"C":  "1 C [ S2 ]",
+		"S1": "1 X",
+	})
+	ls := NewLSystem("A C", rules, vars, consts, false)
+	a := ls.TokenBytes["A"].TokenId()
+	counts, err := ls.CountAt(300)
+	assert.NoError(t, err)
+	// A counts follow the Fibonacci numbers, F(301) at generation 300
+	fib, next := big.NewInt(0), big.NewInt(1)
+	for i := 0; i < 301; i++ {
+		fib.Add(fib, next)
+		fib, next = next, fib
+	}
+	assert.Equal(t, 0, fib.Cmp(counts[a]))
+	// S2 counts down to S1 and becomes X in the same generation
+	assert.Equal(t, int64(299), counts[ls.TokenBytes["X"].TokenId()].Int64())
+
+	generation := ls.IterateUntil(20)
+	length, err := ls.LenAt(20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(generation)), length.Int64())
+	for _, index := range []int{0, 1, 17, 10945, 10946, len(generation) - 1} {
+		token, err := ls.TokenAt(20, index)
+		assert.NoError(t, err)
+		assert.Equal(t, generation[index], token, index)
+	}
+	_, err = ls.TokenAt(20, len(generation))
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = ls.CountAt(-1)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	_, err = ls.LenAt(-1)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	token, err := ls.TokenAt(1_000_000, 5)
+	assert.NoError(t, err)
+	// the derivation of A keeps its prefix
+	assert.Equal(t, generation[5], token)
+
+	// linear growth, lengths saturate at the index
+	vars, consts, rules = ParseRules(map[Token]string{"A": "1 A B", "B": "1 B"})
+	ls = NewLSystem("A", rules, vars, consts, false)
+	for _, index := range []int{0, 5, 1000} {
+		token, err = ls.TokenAt(1_000_000_000, index)
+		assert.NoError(t, err)
+		assert.Equal(t, Token([]string{"A", "B"}[min(index, 1)]), ls.BytesToken[token.TokenId()])
+	}
+
+	// the first token alternates, the descent repeats with period two
+	vars, consts, rules = ParseRules(map[Token]string{"A": "1 B A", "B": "1 A"})
+	ls = NewLSystem("A", rules, vars, consts, false)
+	for n := 0; n < 12; n++ {
+		generation = ls.IterateUntil(n)
+		for index := range generation {
+			token, err = ls.TokenAt(n, index)
+			assert.NoError(t, err)
+			assert.Equal(t, generation[index], token, n)
+		}
+	}
+	token, err = ls.TokenAt(1_000_000_001, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, ls.IterateUntil(11)[3], token)
+
+	vars, consts, rules = ParseRules(map[Token]string{"A": "0.5 A B; 0.5 A"})
+	_, err = NewLSystem("A", rules, vars, consts, false).CountAt(3)
+	assert.ErrorIs(t, err, ErrStochastic)
+}
+
+func TestLint(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A":     `1 A B F_ S3; 0 A`,
+		"B":     `1 *C A; 1 B`,
+		"D":     `1 D`,
+		"E < B": `1 A`,
+		"S1":    `1 X`,
+		"T2":    `1 T1`,
+	})
+	lint := func(axiom Token) map[Token][]error {
+		found := make(map[Token][]error)
+		for _, d := range Lint(axiom, rules, vars, consts) {
+			found[Token(d.Text)] = append(found[Token(d.Text)], d.Err)
+		}
+		return found
+	}
+	assert.Equal(t, map[Token][]error{
+		"0":  {ErrNonPositiveWeight},
+		"C":  {ErrUnproducedCatalyst},
+		"D":  {ErrUnreachableRule},
+		"E":  {ErrDeadAlternative},
+		"T2": {ErrUnreachableRule},
+		"F_": {ErrSuspiciousToken},
+		"X":  {ErrMissingRule},
+		"T":  {ErrMissingCounterRule},
+	}, lint("A"))
+
+	// the rule for S2 is only used for S3, which counts down to S2 before
+	found := lint("S2")
+	assert.Equal(t, []error{ErrUnreachableRule}, found["A"])
+	assert.NotContains(t, found, Token("S1"))
+
+	g, err := LoadGrammar(strings.NewReader("@axiom A\n\nA -> 1 A B\n\nB -> 1 *C A\n"))
+	assert.NoError(t, err)
+	diagnostics := g.Lint()
+	assert.Len(t, diagnostics, 1)
+	assert.Equal(t, 5, diagnostics[0].Line)
+	assert.Equal(t, `rule "B" group 0 at 5:1: catalyst never produced "C"`, diagnostics[0].Error())
+}
+
+func TestServer(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": "1 A B",
+		"B": "1 A",
+	})
+	ls := NewLSystem("A", rules, vars, consts, false)
+	mux := http.NewServeMux()
+	mux.Handle("/analysis/", http.StripPrefix("/analysis", NewServer(ls, AnalysisOptions{Samples: 10}).Handler()))
+	get := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := get(http.MethodGet, "/analysis/stats")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats []struct {
+		Token   Token
+		Samples int
+		Mean    float64
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Len(t, stats, 3)
+	assert.Equal(t, Token("LSystem"), stats[2].Token)
+	assert.Equal(t, 10, stats[2].Samples)
+
+	w = get(http.MethodGet, "/analysis/stats?samples=3&runs=2&seed=9")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 6, stats[0].Samples)
+
+	w = get(http.MethodGet, "/analysis/charts/B?generations=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<html>")
+
+	w = get(http.MethodGet, "/analysis/rules?generations=5")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var alternatives []AlternativeReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &alternatives))
+	assert.Equal(t, AlternativeReport{Token: "B", Weight: 1, Selected: 7, Empirical: 1, Effective: 1}, alternatives[1])
+	assert.Contains(t, get(http.MethodGet, "/analysis/rules/chart").Body.String(), "Rule Firing")
+
+	w = get(http.MethodGet, "/analysis/growth?generations=4&runs=3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "3 runs")
+
+	for path, status := range map[string]int{
+		"/analysis/stats?samples=x":    http.StatusBadRequest,
+		"/analysis/stats?seed=-1":      http.StatusBadRequest,
+		"/analysis/charts/C":           http.StatusNotFound,
+		"/analysis/stats?runs=21":      http.StatusBadRequest,
+		"/analysis/growth?samples=501": http.StatusBadRequest,
+	} {
+		w = get(http.MethodGet, path)
+		assert.Equal(t, status, w.Code, path)
+		assert.Contains(t, w.Body.String(), `"error"`, path)
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, get(http.MethodPost, "/analysis/stats").Code)
+
+	// a client going away stops the analysis, which is not cached
+	canceled, cancelRequest := context.WithCancel(context.Background())
+	cancelRequest()
+	for _, path := range []string{"/stats?runs=20&samples=500", "/growth?generations=500", "/charts"} {
+		w = httptest.NewRecorder()
+		NewServer(ls, AnalysisOptions{}).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil).WithContext(canceled))
+		assert.Equal(t, http.StatusInternalServerError, w.Code, path)
+		assert.Contains(t, w.Body.String(), context.Canceled.Error(), path)
+	}
+	_, err := ls.AnalyseGrowthContext(canceled, 10, AnalysisOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the handler keeps the analysis of its first request
+	handler := ls.HandleStatisticsServer()
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		return w
+	}
+	first := serve().Body.String()
+	ls.Rules = map[Token]ProductionRule{}
+	assert.Equal(t, first, serve().Body.String())
+	ls.Rules = rules
+
+	// concurrent requests share one analysis, run outside the lock
+	shared := NewServer(ls, AnalysisOptions{}).Handler()
+	w = httptest.NewRecorder()
+	shared.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil).WithContext(canceled))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	bodies := make(chan string)
+	for i := 0; i < 4; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			shared.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+			bodies <- w.Body.String()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, first, <-bodies)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewServer(ls, AnalysisOptions{}).ListenAndServe(ctx, "127.0.0.1:0")
+	}()
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestAnalyseGrowth(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": "1 [ A ] B",
+		"B": "0.5 B B; 0.5 B",
+	})
+	ls := NewLSystem("A", rules, vars, consts, false)
+	gs := ls.AnalyseGrowth(6, AnalysisOptions{Runs: 5, Seed: 3})
+	assert.Len(t, gs.Length.Mean, 7)
+	assert.Equal(t, []float64{0, 1, 2, 3, 4, 5, 6}, gs.Depth.Max)
+	assert.Equal(t, gs.Depth.Min, gs.Depth.Max)
+	assert.Equal(t, []float64{1, 1, 1, 1, 1, 1, 1}, gs.Counts["A"].Mean)
+	for g := range gs.Length.Mean {
+		assert.LessOrEqual(t, gs.Length.Min[g], gs.Length.Mean[g])
+		assert.LessOrEqual(t, gs.Length.Mean[g], gs.Length.Max[g])
+	}
+	assert.Less(t, gs.Counts["B"].Min[6], gs.Counts["B"].Max[6])
+	assert.Equal(t, 1, ls.Len())
+
+	var page bytes.Buffer
+	assert.NoError(t, gs.Render(&page))
+	assert.Contains(t, page.String(), "Branch depth")
+
+	// runs stopped by the token limit leave later generations empty
+	gs = ls.AnalyseGrowth(40, AnalysisOptions{MaxTokens: 100})
+	assert.Zero(t, gs.Length.Max[40])
+}
+
+func TestReport(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": `1 A B`,
+		"B": `1 *B A A`,
+	})
+	ls := NewLSystem("A", rules, vars, consts, false, WithSeed(2))
+	report, err := ls.Report(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.Len(t, report.Generations, 5)
+	assert.Equal(t, GenerationReport{Generation: 4, Length: 9, Counts: map[Token]int{"A": 5, "B": 4}}, report.Generations[4])
+	assert.Equal(t, []AlternativeReport{
+		{Token: "A", Alternative: 0, Weight: 1, Selected: 6, Empirical: 1, Effective: 1},
+		{Token: "B", Alternative: 0, Weight: 1, Selected: 5, Blocked: 3, Empirical: 1, Effective: 0.4},
+	}, report.Alternatives)
+	assert.Equal(t, 1, ls.Len())
+
+	report.Rates = RateReports(ls.AnalyseProductionRates(AnalysisOptions{Samples: 4}))
+	var decoded Report
+	var buf bytes.Buffer
+	assert.NoError(t, report.WriteJSON(&buf))
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, *report, decoded)
+
+	buf.Reset()
+	assert.NoError(t, report.WriteCSV(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "kind,generation,token,alternative,metric,value", lines[0])
+	assert.Contains(t, lines, "generation,4,B,,count,4")
+	assert.Contains(t, lines, "alternative,,B,0,blocked,3")
+	assert.Contains(t, lines, "rate,,LSystem,,samples,4")
+
+	rate := ls.AnalyseProductionRates(AnalysisOptions{Samples: 2})["A"]
+	encoded, err := json.Marshal(rate)
+	assert.NoError(t, err)
+	assert.Contains(t, string(encoded), `"token":"A","rule":"\"A\": `+"`"+`1.00 A B `+"`"+`","samples":2`)
+	assert.Contains(t, string(encoded), `"ratios":[`)
+}
+
+func TestRuleCounters(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": `0.3 A C; 0.7 A`,
+		"B": `1 *C B A; 0 B`,
+	})
+	parallel := NewLSystem("A B", rules, vars, consts, false, WithSeed(4), WithWorkers(4), WithRuleCounters())
+	sequential := NewLSystem("A B", rules, vars, consts, false, WithSeed(4), WithWorkers(1), WithRuleCounters())
+	parallel.IterateUntil(24)
+	sequential.IterateUntil(24)
+	counts := parallel.RuleCounts()
+	assert.Equal(t, sequential.RuleCounts(), counts)
+
+	assert.Len(t, counts, 4)
+	assert.Equal(t, 0.3, counts[0].Weight)
+	assert.InDelta(t, 0.3, counts[0].Empirical, 0.1)
+	assert.Equal(t, counts[0].Empirical, counts[0].Effective)
+	assert.Zero(t, counts[3].Selected)
+	// B is blocked unless A has just produced a C
+	assert.Equal(t, 24, counts[2].Selected)
+	assert.Greater(t, counts[2].Blocked, 0)
+	assert.InDelta(t, float64(counts[2].Selected-counts[2].Blocked)/24, counts[2].Effective, 1e-9)
+
+	parallel.Reset()
+	assert.Zero(t, parallel.RuleCounts()[0].Selected)
+	assert.Nil(t, NewLSystem("A", rules, vars, consts, false).RuleCounts())
+}
+
+func TestSnapshot(t *testing.T) {
+	vars, consts, rules := ParseRules(map[Token]string{
+		"A": `0.5 A B; 0.3 B A; 0.2 *B A A`,
+		"B": `0.6 B; 0.4 A`,
+	})
+	whole := NewLSystem("A", rules, vars, consts, true, WithSeed(7))
+	whole.IterateUntil(10)
+
+	ls := NewLSystem("A", rules, vars, consts, true, WithSeed(7))
+	ls.IterateUntil(6)
+	var buf bytes.Buffer
+	_, err := ls.Snapshot().WriteTo(&buf)
+	assert.NoError(t, err)
+	snapshot, err := ReadSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, ls.Snapshot(), snapshot)
+
+	// restored with other ids and another seed
+	_, _, rules = ParseRules(map[Token]string{
+		"A": `0.5 A B; 0.3 B A; 0.2 *B A A`,
+		"B": `0.6 B; 0.4 A`,
+	})
+	resumed := NewLSystem("A", rules, vars, consts, true, WithSeed(1))
+	assert.NoError(t, resumed.Restore(snapshot))
+	assert.Equal(t, uint64(7), resumed.Seed())
+	resumed.Iterate(4)
+	assert.Equal(t, whole.DecodeBytes(whole.MemPool.ReadAll()), resumed.DecodeBytes(resumed.MemPool.ReadAll()))
+
+	// pre-sampled choices must name an alternative
+	bad := ls.Snapshot()
+	bad.Rules[0].PreSampled[0] = 9
+	assert.ErrorIs(t, resumed.Restore(bad), ErrSnapshotMismatch)
+	buf.Reset()
+	_, err = bad.WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = ReadSnapshot(&buf)
+	assert.ErrorIs(t, err, ErrBinaryFormat)
+
+	parametric := map[Token]string{
+		"A(t)": `0.5 A(t+1) B(t); 0.5 B(t) A(t*2)`,
+		"B(t)": `1 B(t/2)`,
+	}
+	vars, consts, rules = ParseRules(parametric)
+	whole = NewLSystem("A(1)", rules, vars, consts, false, WithSeed(3))
+	whole.IterateUntil(8)
+	ls = NewLSystem("A(1)", rules, vars, consts, false, WithSeed(3))
+	ls.IterateUntil(5)
+	buf.Reset()
+	_, err = ls.Snapshot().WriteTo(&buf)
+	assert.NoError(t, err)
+	snapshot, err = ReadSnapshot(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, ls.Restore(snapshot))
+	ls.Iterate(3)
+	assert.Equal(t, modulesString(whole.ReadModules()), modulesString(ls.ReadModules()))
+
+	other := NewLSystem("X", rules, vars, consts, false)
+	assert.ErrorIs(t, NewLSystem("C", map[Token]ProductionRule{}, TokenSet{"C": {}}, TokenSet{}, false).Restore(snapshot), ErrSnapshotMismatch)
+	assert.NoError(t, other.Restore(snapshot))
+
+	_, err = ReadSnapshot(strings.NewReader("LSYS"))
+	assert.ErrorIs(t, err, ErrBinaryFormat)
+	_, err = ReadSnapshot(bytes.NewReader(append([]byte("LSYS"), 9)))
+	assert.ErrorIs(t, err, ErrBinaryVersion)
+}
+
+func TestCompiledLSystem(t *testing.T) {
+	grammar := map[Token]string{
+		"A(t) : t > 2":         `0.7 F(sin(t) * 2) [ +(25) A(t-1) ] A(t-1); 0.3 A(t-1) C2`,
+		"A(t) : t <= 2":        `1 X(t)`,
+		"F(l) < X(y) : y == 2": `1 X(l+y) C`,
+		"C":                    `0.5 *X C; 0.5 B`,
+		"B":                    `0.4 B B; 0.6 F(1)`,
+	}
+	vars, consts, rules := ParseRules(grammar)
+	ls := NewLSystem("A(5) C3", rules, vars, consts, true, WithSeed(11), WithContextIgnore("+"))
+	for i := 0; i < 5; i++ {
+		vars, consts, rules := ParseRules(grammar)
+		assert.Equal(t, ls.BytesToken, NewLSystem("A(5) C3", rules, vars, consts, true).BytesToken)
+	}
+
+	var buf bytes.Buffer
+	_, err := ls.WriteTo(&buf)
+	assert.NoError(t, err)
+	encoded := buf.Bytes()
+	loaded, err := ReadLSystem(bytes.NewReader(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, ls.BytesToken, loaded.BytesToken)
+	assert.Equal(t, ls.Rules, loaded.Rules)
+	assert.Equal(t, ls.String(), loaded.String())
+	ls.IterateUntil(6)
+	loaded.IterateUntil(6)
+	assert.Equal(t, modulesString(ls.ReadModules()), modulesString(loaded.ReadModules()))
+	assert.Greater(t, ls.Len(), 10)
+
+	reseeded, err := ReadLSystem(bytes.NewReader(encoded), WithSeed(3))
+	assert.NoError(t, err)
+	fresh := NewLSystem("A(5) C3", rules, vars, consts, true, WithSeed(3), WithContextIgnore("+"))
+	reseeded.IterateUntil(6)
+	fresh.IterateUntil(6)
+	assert.Equal(t, modulesString(fresh.ReadModules()), modulesString(reseeded.ReadModules()))
+
+	buf.Reset()
+	_, err = ls.Stream().WriteTo(&buf)
+	assert.NoError(t, err)
+	stream, err := ReadTokenStream(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ls.ReadModules(), stream.Modules())
+	ids, err := fresh.MapStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, ls.MemPool.ReadAll(), ids)
+	_, err = NewLSystem("X", map[Token]ProductionRule{}, TokenSet{"X": {}}, TokenSet{}, false).MapStream(stream)
+	assert.ErrorIs(t, err, ErrUnknownToken)
+
+	for _, n := range []int{0, 4, 5, len(encoded) / 2, len(encoded) - 1} {
+		_, err = ReadLSystem(bytes.NewReader(encoded[:n]))
+		assert.ErrorIs(t, err, ErrBinaryFormat)
+	}
+	_, err = ReadLSystem(bytes.NewReader(append([]byte("LSYC"), 2)))
+	assert.ErrorIs(t, err, ErrBinaryVersion)
+
+	// rules that could not be run are corrupt
+	corrupt := NewLSystem("A(5) C3", rules, vars, consts, true)
+	for i := range corrupt.ByteRules[corrupt.TokenBytes["A"].TokenId()].Weights {
+		alt := &corrupt.ByteRules[corrupt.TokenBytes["A"].TokenId()].Weights[i]
+		alt.Arguments = alt.Arguments[:len(alt.Arguments)-1]
+	}
+	buf.Reset()
+	_, err = corrupt.WriteTo(&buf)
+	assert.NoError(t, err)
+	_, err = ReadLSystem(&buf)
+	assert.ErrorIs(t, err, ErrBinaryFormat)
+}
@@ -0,0 +1,136 @@
+package lsystem
+
+import "math"
+
+// ProductionMatrix holds the expected number of tokens every token produces in
+// one generation, for computing growth without deriving any generation. Rows,
+// columns and count vectors are indexed by TokenId.
+type ProductionMatrix struct {
+	Tokens []Token
+	// M[i][j] is the expected number of tokens j a token i rewrites to.
+	M [][]float64
+	// Axiom counts the tokens of the axiom.
+	Axiom []float64
+	// Approximate lists the tokens whose rows are approximations: alternatives
+	// with a catalyst, context or condition are counted as if they always
+	// applied, while whether they do depends on the neighbours and parameters
+	// of every token.
+	Approximate []Token
+}
+
+// ProductionMatrix builds the production matrix of the current weights of l.
+func (l *LSystem) ProductionMatrix() *ProductionMatrix {
+	n := len(l.BytesToken)
+	m := &ProductionMatrix{
+		Tokens: l.BytesToken,
+		M:      make([][]float64, n),
+		Axiom:  make([]float64, n),
+	}
+	for _, id := range l.axiomIds {
+		m.Axiom[id.TokenId()]++
+	}
+
+	for i := range m.M {
+		row := make([]float64, n)
+		m.M[i] = row
+		token := NewTokenStateId(uint32(i), l.Params[i] > 0)
+		if token.HasParam() && l.Params[i] > 1 {
+			token--
+		}
+		rules := &l.ByteRules[token.TokenId()]
+		total := 0.0
+		if rules.Weights != nil {
+			total = rules.Weights[len(rules.Weights)-1].UpperLimit
+		}
+		if total == 0 {
+			row[token.TokenId()] = 1
+			continue
+		}
+
+		approximate := false
+		for k := range rules.Weights {
+			wt := &rules.Weights[k]
+			p := (wt.UpperLimit - wt.LowerLimit) / total
+			for _, successor := range wt.Successor {
+				row[successor.TokenId()] += p
+			}
+			approximate = approximate || wt.Catalyst != l.EmptyTokenId || wt.HasContext() || wt.Condition != nil
+		}
+		if approximate {
+			m.Approximate = append(m.Approximate, l.BytesToken[i])
+		}
+	}
+	return m
+}
+
+// Step returns the expected counts of the generation following one with the
+// given counts.
+func (m *ProductionMatrix) Step(counts []float64) []float64 {
+	next := make([]float64, len(counts))
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		for j, produced := range m.M[i] {
+			next[j] += count * produced
+		}
+	}
+	return next
+}
+
+// ExpectedCounts returns the expected number of every token in generation n.
+func (m *ProductionMatrix) ExpectedCounts(n int) []float64 {
+	counts := m.Axiom
+	for i := 0; i < n; i++ {
+		counts = m.Step(counts)
+	}
+	return counts
+}
+
+// Growth returns the asymptotic growth rate of the tokens reachable from the
+// axiom, the dominant eigenvalue of the matrix, and the composition the
+// generations tend to, its eigenvector normalised to sum to 1.
+func (m *ProductionMatrix) Growth() (rate float64, composition []float64) {
+	const maxIterations = 100_000
+	composition = normalise(m.Axiom)
+	if composition == nil {
+		return 0, make([]float64, len(m.Axiom))
+	}
+
+	// iterating M+I has the same eigenvectors and converges when the
+	// dominant eigenvalue of M is not the only one of its magnitude
+	for i := 0; i < maxIterations; i++ {
+		next := m.Step(composition)
+		for j := range next {
+			next[j] += composition[j]
+		}
+		next = normalise(next)
+		delta := 0.0
+		for j := range next {
+			delta = max(delta, math.Abs(next[j]-composition[j]))
+		}
+		composition = next
+		if delta < 1e-13 {
+			break
+		}
+	}
+	for _, count := range m.Step(composition) {
+		rate += count
+	}
+	return rate, composition
+}
+
+func normalise(counts []float64) []float64 {
+	sum := 0.0
+	for _, count := range counts {
+		sum += count
+	}
+	if sum == 0 {
+		return nil
+	}
+	normalised := make([]float64, len(counts))
+	for i, count := range counts {
+		normalised[i] = count / sum
+	}
+	return normalised
+}
@@ -1,72 +1,318 @@
 package lsystem
 
+import "runtime"
+
+// Buffer holds tokens packed with the id width of its pool, so that small
+// alphabets take a byte per token, see AppendPackedIds. The tokens are no
+// longer exposed as the BytePairs slice, read them with At or AppendIds.
 type Buffer struct {
-	BytePairs []TokenStateId
-	Len       int
-	Cap       int
+	ids8  []uint8
+	ids16 []uint16
+	ids32 []TokenStateId
+	width int
+	Len   int
+	Cap   int
+
+	// Args holds the arguments of parametric modules and ArgIndex the index
+	// of the first argument of each token. ArgIndex is nil unless the buffer
+	// belongs to a parametric system.
+	Args     []float64
+	ArgIndex []int32
 }
 
-func (m *Buffer) Append(bp TokenStateId) {
+// idWord is the type a buffer stores ids with, the counter flag taking its
+// top bit.
+type idWord interface {
+	~uint8 | ~uint16 | ~uint32
+}
+
+func unpackWord[W idWord](w W) TokenStateId {
+	flag := ^W(0)>>1 + 1
+	return NewTokenStateId(uint32(w&^flag), w&flag != 0)
+}
+
+func packWord[W idWord](id TokenStateId) W {
+	w := W(id.TokenId())
+	if id.HasParam() {
+		w |= ^W(0)>>1 + 1
+	}
+	return w
+}
+
+func newBuffer(capacity, width int) *Buffer {
+	m := &Buffer{width: width}
+	m.resize(capacity)
+	return m
+}
+
+// At returns the token at index i.
+func (m *Buffer) At(i int) TokenStateId {
+	switch m.width {
+	case 8:
+		return unpackWord(m.ids8[i])
+	case 16:
+		return unpackWord(m.ids16[i])
+	}
+	return m.ids32[i]
+}
+
+func (m *Buffer) set(i int, id TokenStateId) {
+	switch m.width {
+	case 8:
+		m.ids8[i] = packWord[uint8](id)
+	case 16:
+		m.ids16[i] = packWord[uint16](id)
+	default:
+		m.ids32[i] = id
+	}
+}
+
+// BytePairs returns a copy of the tokens of m. It used to be the field m kept
+// them in, writes to the copy no longer reach m.
+func (m *Buffer) BytePairs() []TokenStateId {
+	return m.AppendIds(nil, 0, m.Len)
+}
+
+// AppendIds appends the tokens m holds in [from, to) to dst.
+func (m *Buffer) AppendIds(dst []TokenStateId, from, to int) []TokenStateId {
+	switch m.width {
+	case 8:
+		return appendUnpacked(dst, m.ids8[from:to])
+	case 16:
+		return appendUnpacked(dst, m.ids16[from:to])
+	}
+	return append(dst, m.ids32[from:to]...)
+}
+
+// view returns the tokens of m, sharing the storage of 32 bit buffers and
+// unpacking narrower ones into dst otherwise.
+func (m *Buffer) view(dst []TokenStateId) []TokenStateId {
+	if m.width == 32 {
+		return m.ids32[:m.Len]
+	}
+	return m.AppendIds(dst[:0], 0, m.Len)
+}
+
+func appendUnpacked[W idWord](dst []TokenStateId, words []W) []TokenStateId {
+	for _, w := range words {
+		dst = append(dst, unpackWord(w))
+	}
+	return dst
+}
+
+// appendWords is AppendSlice for a buffer storing its ids in words.
+func appendWords[W idWord](m *Buffer, words *[]W, bps []TokenStateId) {
+	if m.Len+len(bps) > m.Cap {
+		m.Grow(m.Len + len(bps))
+	}
+
+	dst := (*words)[m.Len : m.Len+len(bps)]
+	for i, bp := range bps {
+		dst[i] = packWord[W](bp)
+	}
+	if m.ArgIndex != nil {
+		for i := range bps {
+			m.ArgIndex[m.Len+i] = int32(len(m.Args))
+		}
+	}
+	m.Len += len(bps)
+}
+
+// appendWord is Append for a buffer storing its ids in words.
+func appendWord[W idWord](m *Buffer, words *[]W, bp TokenStateId) {
 	if m.Len >= m.Cap {
 		m.Grow(m.Len)
 	}
 
-	m.BytePairs[m.Len] = bp
+	(*words)[m.Len] = packWord[W](bp)
+	if m.ArgIndex != nil {
+		m.ArgIndex[m.Len] = int32(len(m.Args))
+	}
 	m.Len++
 }
 
+func (m *Buffer) Append(bp TokenStateId) {
+	switch m.width {
+	case 8:
+		appendWord(m, &m.ids8, bp)
+	case 16:
+		appendWord(m, &m.ids16, bp)
+	default:
+		appendWord(m, &m.ids32, bp)
+	}
+}
+
 func (m *Buffer) AppendSlice(bps []TokenStateId) {
-	if m.Len+len(bps) > m.Cap {
-		m.Grow(m.Len + len(bps))
+	switch m.width {
+	case 8:
+		appendWords(m, &m.ids8, bps)
+	case 16:
+		appendWords(m, &m.ids16, bps)
+	default:
+		appendWords(m, &m.ids32, bps)
+	}
+}
+
+func (m *Buffer) AppendModule(bp TokenStateId, args []float64) {
+	m.Append(bp)
+	m.Args = append(m.Args, args...)
+}
+
+// AppendRange appends the tokens src holds in [from, to) with their arguments.
+func (m *Buffer) AppendRange(src *Buffer, from, to int) {
+	if src.ArgIndex != nil && m.ArgIndex != nil {
+		for i := from; i < to; i++ {
+			m.AppendModule(src.At(i), src.ModuleArgs(i))
+		}
+		return
+	}
+	if m.Len+to-from > m.Cap {
+		m.Grow(m.Len + to - from)
 	}
+	switch {
+	case m.width != src.width:
+		for i := from; i < to; i++ {
+			m.set(m.Len+i-from, src.At(i))
+		}
+	case m.width == 8:
+		copy(m.ids8[m.Len:], src.ids8[from:to])
+	case m.width == 16:
+		copy(m.ids16[m.Len:], src.ids16[from:to])
+	default:
+		copy(m.ids32[m.Len:], src.ids32[from:to])
+	}
+	if m.ArgIndex != nil {
+		for i := m.Len; i < m.Len+to-from; i++ {
+			m.ArgIndex[i] = int32(len(m.Args))
+		}
+	}
+	m.Len += to - from
+}
 
-	copy(m.BytePairs[m.Len:], bps)
-	m.Len += len(bps)
+// ModuleArgs returns the arguments of the token at index i.
+func (m *Buffer) ModuleArgs(i int) []float64 {
+	if m.ArgIndex == nil {
+		return nil
+	}
+	end := int32(len(m.Args))
+	if i+1 < m.Len {
+		end = m.ArgIndex[i+1]
+	}
+	return m.Args[m.ArgIndex[i]:end]
+}
+
+func (m *Buffer) Clear() {
+	m.Len = 0
+	m.Args = m.Args[:0]
 }
 
 func (m *Buffer) Grow(atLeast int) {
-	newCap := int(float32(atLeast) * 1.5)
-	m.Cap = newCap
+	m.resize(int(float32(atLeast) * 1.5))
+}
+
+// resize reallocates the storage of m for capacity tokens, keeping the first
+// Len.
+func (m *Buffer) resize(capacity int) {
+	m.Cap = capacity
+	switch m.width {
+	case 8:
+		ids := make([]uint8, capacity)
+		copy(ids, m.ids8[:m.Len])
+		m.ids8 = ids
+	case 16:
+		ids := make([]uint16, capacity)
+		copy(ids, m.ids16[:m.Len])
+		m.ids16 = ids
+	default:
+		ids := make([]TokenStateId, capacity)
+		copy(ids, m.ids32[:m.Len])
+		m.ids32 = ids
+	}
+
+	if m.ArgIndex != nil {
+		newIndex := make([]int32, capacity)
+		copy(newIndex, m.ArgIndex)
+		m.ArgIndex = newIndex
+	}
+}
 
-	newSlice := make([]TokenStateId, newCap)
-	copy(newSlice, m.BytePairs)
-	m.BytePairs = newSlice
+// bytes returns the memory held by m.
+func (m *Buffer) bytes() int {
+	return m.width/8*m.Cap + 4*cap(m.ArgIndex) + 8*cap(m.Args)
 }
 
-const threadCount = 4
+// widen repacks the tokens of m with width bits each.
+func (m *Buffer) widen(width int) {
+	ids := m.AppendIds(nil, 0, m.Len)
+	m.ids8, m.ids16, m.ids32 = nil, nil, nil
+	m.width, m.Len = width, 0
+	m.resize(m.Cap)
+	for i, id := range ids {
+		m.set(i, id)
+	}
+	m.Len = len(ids)
+}
 
+// MemPool holds the double buffered chunks a generation is split into.
 type MemPool struct {
-	readBuffers  [threadCount]*Buffer
-	writeBuffers [threadCount]*Buffer
+	readBuffers  []*Buffer
+	writeBuffers []*Buffer
 
-	swap [threadCount]bool
+	swap  []bool
+	width int
+
+	// unpacked holds the tokens readView unpacks from narrow buffers
+	unpacked []TokenStateId
 }
 
+// NewMemPool creates a pool with four chunks per available CPU.
 func NewMemPool(capacity int) *MemPool {
-	readBuffers := [threadCount]*Buffer{}
-	writeBuffers := [threadCount]*Buffer{}
-	swapValues := [threadCount]bool{}
-
-	for i := 0; i < threadCount; i++ {
-		readBuffers[i] = &Buffer{
-			BytePairs: make([]TokenStateId, capacity),
-			Len:       0,
-			Cap:       capacity,
-		}
+	return NewMemPoolWithChunks(capacity, 4*runtime.GOMAXPROCS(0))
+}
 
-		writeBuffers[i] = &Buffer{
-			BytePairs: make([]TokenStateId, capacity),
-			Len:       0,
-			Cap:       capacity,
-		}
+// NewMemPoolWithChunks creates a pool storing ids with 32 bits, see
+// NewMemPoolWithWidth.
+func NewMemPoolWithChunks(capacity, chunks int) *MemPool {
+	return NewMemPoolWithWidth(capacity, chunks, 32)
+}
+
+// NewMemPoolWithWidth creates a pool storing ids with width bits, 8, 16 or 32
+// as returned by LSystem.IdWidth.
+func NewMemPoolWithWidth(capacity, chunks, width int) *MemPool {
+	m := &MemPool{
+		readBuffers:  make([]*Buffer, chunks),
+		writeBuffers: make([]*Buffer, chunks),
+		swap:         make([]bool, chunks),
+		width:        width,
 	}
+	for i := 0; i < chunks; i++ {
+		m.readBuffers[i] = newBuffer(capacity, width)
+		m.writeBuffers[i] = newBuffer(capacity, width)
+	}
+	return m
+}
 
-	return &MemPool{
-		readBuffers:  readBuffers,
-		writeBuffers: writeBuffers,
+// IdWidth returns the number of bits the pool stores an id with.
+func (m *MemPool) IdWidth() int {
+	return m.width
+}
 
-		swap: swapValues,
+// Widen makes the pool store ids with at least width bits, repacking the
+// tokens it holds.
+func (m *MemPool) Widen(width int) {
+	if width <= m.width {
+		return
 	}
+	m.width = width
+	for i := range m.readBuffers {
+		m.readBuffers[i].widen(width)
+		m.writeBuffers[i].widen(width)
+	}
+}
+
+// Chunks returns the number of buffers a generation can be split into.
+func (m *MemPool) Chunks() int {
+	return len(m.readBuffers)
 }
 
 func (m *MemPool) GetReadBuffer(idx int) *Buffer {
@@ -76,6 +322,16 @@ func (m *MemPool) GetReadBuffer(idx int) *Buffer {
 	return m.readBuffers[idx]
 }
 
+// readView returns the tokens of read buffer idx without copying them when
+// they are stored with 32 bits, see Buffer.view.
+func (m *MemPool) readView(idx int) []TokenStateId {
+	ids := m.GetReadBuffer(idx).view(m.unpacked)
+	if m.width < 32 {
+		m.unpacked = ids
+	}
+	return ids
+}
+
 func (m *MemPool) GetWriteBuffer(idx int) *Buffer {
 	if m.swap[idx] {
 		return m.readBuffers[idx]
@@ -83,37 +339,59 @@ func (m *MemPool) GetWriteBuffer(idx int) *Buffer {
 	return m.writeBuffers[idx]
 }
 
+// EnableArgs makes all buffers track the arguments of parametric modules.
+func (m *MemPool) EnableArgs() {
+	for i := range m.readBuffers {
+		for _, buf := range []*Buffer{m.readBuffers[i], m.writeBuffers[i]} {
+			if buf.ArgIndex == nil {
+				buf.ArgIndex = make([]int32, buf.Cap)
+			}
+		}
+	}
+}
+
 func (m *MemPool) SwapAll() {
-	for i := 0; i < threadCount; i++ {
+	for i := range m.swap {
 		m.swap[i] = !m.swap[i]
 		writeBuf := m.GetWriteBuffer(i)
-		writeBuf.Len = 0
+		writeBuf.Clear()
 	}
 }
 
 func (m *MemPool) Swap(idx int) {
 	m.swap[idx] = !m.swap[idx]
 	writeBuf := m.GetWriteBuffer(idx)
-	writeBuf.Len = 0
+	writeBuf.Clear()
 }
 
 func (m *MemPool) Reset() {
-	for i := 0; i < threadCount; i++ {
+	for i := range m.swap {
 		readBuf := m.GetReadBuffer(i)
-		readBuf.Len = 0
+		readBuf.Clear()
 
 		writeBuf := m.GetWriteBuffer(i)
-		writeBuf.Len = 0
+		writeBuf.Clear()
 
 		m.swap[i] = false
 	}
 }
 
+// Bytes returns the memory held by all buffers.
+func (m *MemPool) Bytes() int {
+	bytes := 0
+	for i := range m.readBuffers {
+		for _, buf := range []*Buffer{m.readBuffers[i], m.writeBuffers[i]} {
+			bytes += buf.bytes()
+		}
+	}
+	return bytes
+}
+
 func (m *MemPool) ReadAll() []TokenStateId {
 	tokens := []TokenStateId{}
-	for i := 0; i < threadCount; i++ {
+	for i := range m.swap {
 		buf := m.GetReadBuffer(i)
-		tokens = append(tokens, buf.BytePairs[:buf.Len]...)
+		tokens = buf.AppendIds(tokens, 0, buf.Len)
 	}
 
 	return tokens
@@ -1,46 +1,215 @@
 package lsystem
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
+var (
+	ErrMalformedWeight  = errors.New("malformed weight")
+	ErrEmptySuccessor   = errors.New("empty successor")
+	ErrDanglingCatalyst = errors.New("dangling catalyst marker")
+	ErrUnknownToken     = errors.New("unknown token")
+	ErrMalformedContext = errors.New("malformed context")
+)
+
+// ParseError describes a problem with a single group of a rule. Group is the
+// zero-based index of the ';' separated group, Line and Column are one-based
+// and point into the rule string as it was passed to the parser. Problems with
+// the rule key itself have Group -1 and a Column pointing into the key.
+type ParseError struct {
+	Rule   Token
+	Group  int
+	Line   int
+	Column int
+	Text   string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("rule %q group %d: %v %q", e.Rule, e.Group, e.Err, e.Text)
+	}
+	return fmt.Sprintf("rule %q group %d at %d:%d: %v %q", e.Rule, e.Group, e.Line, e.Column, e.Err, e.Text)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+type ParseErrors []*ParseError
+
+func (e ParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (e ParseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+type ParseOptions struct {
+	// Strict fails on any diagnostic. Otherwise every group with a diagnostic
+	// is dropped and all diagnostics are returned as warnings.
+	Strict bool
+	// Alphabet, when non-nil, lists the tokens rules may reference in addition
+	// to the rule keys themselves. Anything else is reported as unknown.
+	Alphabet TokenSet
+}
+
+// ParseRule parses rule groups leniently, silently dropping malformed groups.
 func ParseRule(str string) []WeightedRule {
-	groups := strings.Split(strings.ReplaceAll(str, "\n", ""), ";")
+	weightedTokens, _ := parseRule("", str, ParseOptions{}, nil)
+	return weightedTokens
+}
+
+// ParseRuleWithOptions parses the groups of the rule for key and reports every
+// malformed group. In strict mode the returned error holds all diagnostics.
+func ParseRuleWithOptions(key Token, str string, opts ParseOptions) ([]WeightedRule, ParseErrors, error) {
+	weightedTokens, diagnostics := parseRule(key, str, opts, nil)
+	if opts.Strict && len(diagnostics) > 0 {
+		return nil, nil, diagnostics
+	}
+	return weightedTokens, diagnostics, nil
+}
+
+// parseRule parses the groups of the rule for key, which is either a single
+// predecessor or a context pattern such as "A B < S > C".
+func parseRule(key Token, str string, opts ParseOptions, predecessors TokenSet) ([]WeightedRule, ParseErrors) {
 	var weightedTokens []WeightedRule
+	var diagnostics ParseErrors
+
+	context, keyDiagnostic := parseKey(key)
+	if keyDiagnostic != nil {
+		return nil, ParseErrors{keyDiagnostic}
+	}
 
-	for _, group := range groups {
-		if strings.TrimSpace(group) == "" {
+	report := func(group int, f field, err error) {
+		line, column := position(str, f.offset)
+		diagnostics = append(diagnostics, &ParseError{
+			Rule:   key,
+			Group:  group,
+			Line:   line,
+			Column: column,
+			Text:   f.text,
+			Err:    err,
+		})
+	}
+	known := func(t Token) bool {
+		if opts.Alphabet == nil {
+			return true
+		}
+		return opts.Alphabet.Contains(t) || predecessors.Contains(t) || t == context.Predecessor
+	}
+	keyError := func(f field, err error) ParseErrors {
+		return ParseErrors{{Rule: key, Group: -1, Line: 1, Column: f.offset + 1, Text: f.text, Err: err}}
+	}
+	for i, t := range append(context.Left, context.Right...) {
+		if !known(t) {
+			return nil, keyError(context.modules[i], ErrUnknownToken)
+		}
+	}
+
+	names := context.parameterNames()
+	if context.Condition != "" {
+		if _, err := CompileExpression(context.Condition, names); err != nil {
+			return nil, keyError(field{text: context.Condition, offset: context.conditionOffset}, err)
+		}
+	}
+
+	for groupIdx, group := range splitGroups(str) {
+		tokens := splitFields(group.text, group.offset)
+		if len(tokens) == 0 {
 			continue
 		}
-		tokens := strings.Fields(group)
-		weight, err := strconv.ParseFloat(tokens[0], 64)
+		reported := len(diagnostics)
+		weight, err := strconv.ParseFloat(tokens[0].text, 64)
 		if err != nil {
+			report(groupIdx, tokens[0], ErrMalformedWeight)
 			continue
 		}
 
 		// expect *Token to indicate a catalyst requirement on [1]
-		if len(tokens) > 1 && tokens[1][0] == '*' {
-			weightedTokens = append(weightedTokens, WeightedRule{
-				Probability: weight,
-				Catalyst:    Token(tokens[1][1:]),
-				Tokens:      symbolsToTokens(tokens[2:]),
-			})
-			continue
+		rule := WeightedRule{
+			Probability:  weight,
+			Left:         context.Left,
+			Right:        context.Right,
+			Formals:      context.Formals,
+			LeftFormals:  context.LeftFormals,
+			RightFormals: context.RightFormals,
+			Condition:    context.Condition,
+		}
+		successor := tokens[1:]
+		if len(tokens) > 1 && tokens[1].text[0] == '*' {
+			rule.Catalyst = Token(tokens[1].text[1:])
+			successor = tokens[2:]
+			if rule.Catalyst == "" {
+				report(groupIdx, tokens[1], ErrDanglingCatalyst)
+			} else if !known(rule.Catalyst) {
+				report(groupIdx, tokens[1], ErrUnknownToken)
+			}
+		}
+		// a bare * ends up here too and is reported as dangling instead
+		if len(successor) == 0 && tokens[len(tokens)-1].text != "*" {
+			report(groupIdx, group.trimmed(), ErrEmptySuccessor)
 		}
 
-		weightedTokens = append(weightedTokens, WeightedRule{
-			Probability: weight,
-			Tokens:      symbolsToTokens(tokens[1:]),
-		})
+		for i, t := range successor {
+			name, args, ok := splitModule(t.text)
+			if !ok {
+				report(groupIdx, t, ErrMalformedExpression)
+				continue
+			}
+			for _, arg := range args {
+				if _, err := CompileExpression(arg, names); err != nil {
+					report(groupIdx, t, err)
+				}
+			}
+			if t.text[0] == '*' {
+				report(groupIdx, t, ErrDanglingCatalyst)
+			} else if !validToken(name) || !known(Token(name)) {
+				report(groupIdx, t, ErrUnknownToken)
+			}
+			if args != nil && rule.Arguments == nil {
+				rule.Arguments = make([][]string, len(successor))
+			}
+			if args != nil {
+				rule.Arguments[i] = args
+			}
+			rule.Tokens = append(rule.Tokens, Token(name))
+		}
+		if len(diagnostics) > reported {
+			continue
+		}
+		weightedTokens = append(weightedTokens, rule)
 	}
-	return weightedTokens
+	return weightedTokens, diagnostics
 }
 
+// ParseRules parses all rules leniently, silently dropping malformed groups.
 func ParseRules(rulesMap map[Token]string) (TokenSet, TokenSet, map[Token]ProductionRule) {
-	vars := make(TokenSet)
-	consts := make(TokenSet)
-	parsedRules := make(map[Token]ProductionRule)
+	vars, consts, parsedRules, _, _ := ParseRulesWithOptions(rulesMap, ParseOptions{})
+	return vars, consts, parsedRules
+}
+
+// ParseRulesWithOptions parses all rules and classifies their tokens. Lenient
+// parsing returns the diagnostics as warnings, strict parsing returns them as
+// err and no rules.
+func ParseRulesWithOptions(rulesMap map[Token]string, opts ParseOptions) (vars, consts TokenSet, rules map[Token]ProductionRule, warnings ParseErrors, err error) {
+	vars = make(TokenSet)
+	consts = make(TokenSet)
+	rules = make(map[Token]ProductionRule)
 
 	indexToken := func(token Token) {
 		if isVariable(token) {
@@ -49,25 +218,259 @@ func ParseRules(rulesMap map[Token]string) (TokenSet, TokenSet, map[Token]Produc
 			consts.Add(token)
 		}
 	}
-	for key, value := range rulesMap {
-		indexToken(key)
-		parsedRules[key] = NewProductionRule(key, ParseRule(value))
 
-		for _, wt := range parsedRules[key].Weights {
+	keys := make([]Token, 0, len(rulesMap))
+	predecessors := make(TokenSet)
+	for key := range rulesMap {
+		keys = append(keys, key)
+		if context, err := parseKey(key); err == nil {
+			predecessors.Add(context.Predecessor)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		weights, diagnostics := parseRule(key, rulesMap[key], opts, predecessors)
+		warnings = append(warnings, diagnostics...)
+		context, err := parseKey(key)
+		if err != nil {
+			continue
+		}
+
+		// rules with a context are merged with the other rules of their predecessor
+		indexToken(context.Predecessor)
+		rule := rules[context.Predecessor]
+		rules[context.Predecessor] = NewProductionRule(context.Predecessor, append(rule.Weights, weights...))
+
+		for _, wt := range weights {
 			indexToken(wt.Catalyst)
+			for _, token := range wt.Left {
+				indexToken(token)
+			}
+			for _, token := range wt.Right {
+				indexToken(token)
+			}
 			for _, token := range wt.Tokens {
 				indexToken(token)
 			}
 		}
 	}
 
-	return vars, consts, parsedRules
+	if opts.Strict && len(warnings) > 0 {
+		return nil, nil, nil, nil, warnings
+	}
+	return vars, consts, rules, warnings, nil
+}
+
+type ruleContext struct {
+	Left         []Token
+	Predecessor  Token
+	Right        []Token
+	Formals      []string
+	LeftFormals  [][]string
+	RightFormals [][]string
+	Condition    string
+
+	// modules holds the fields of the modules of Left and Right in order,
+	// conditionOffset where Condition starts in the key, for diagnostics.
+	modules         []field
+	conditionOffset int
+}
+
+// parameterNames lists the parameters bound by a rule: those of the
+// predecessor followed by those of the left and right context modules.
+func (c *ruleContext) parameterNames() []string {
+	return parameterNames(c.Formals, c.LeftFormals, c.RightFormals)
+}
+
+func parameterNames(formals []string, leftFormals, rightFormals [][]string) []string {
+	if leftFormals == nil && rightFormals == nil {
+		return formals
+	}
+	names := append([]string{}, formals...)
+	for _, f := range leftFormals {
+		names = append(names, f...)
+	}
+	for _, f := range rightFormals {
+		names = append(names, f...)
+	}
+	return names
+}
+
+// parseKey splits a rule key of the form
+// "[left... <] predecessor [> right...] [: condition]", where every module may
+// name its parameters, as in "A(x) < B(y) : x > y".
+func parseKey(key Token) (ruleContext, *ParseError) {
+	malformed := func(f field) (ruleContext, *ParseError) {
+		return ruleContext{}, &ParseError{Rule: key, Group: -1, Line: 1, Column: f.offset + 1, Text: f.text, Err: ErrMalformedContext}
+	}
+
+	pattern, condition, conditionOffset := string(key), "", 0
+	depth := 0
+	for i, r := range pattern {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ':':
+			if depth == 0 {
+				pattern, condition = pattern[:i], strings.TrimSpace(pattern[i+1:])
+				conditionOffset = strings.Index(string(key[i:]), condition) + i
+				if condition == "" {
+					return malformed(field{text: string(key[i:]), offset: i})
+				}
+			}
+		}
+		if condition != "" {
+			break
+		}
+	}
+
+	fields := splitFields(pattern, 0)
+	if len(fields) == 0 {
+		return malformed(field{})
+	}
+
+	lt, gt := -1, -1
+	for i, f := range fields {
+		switch {
+		case f.text == "<" && lt < 0 && gt < 0:
+			lt = i
+		case f.text == ">" && gt < 0:
+			gt = i
+		case f.text == "<" || f.text == ">":
+			return malformed(f)
+		}
+	}
+	end := len(fields)
+	if gt >= 0 {
+		end = gt
+	}
+	switch {
+	case lt == 0:
+		return malformed(fields[lt])
+	case gt == len(fields)-1:
+		return malformed(fields[gt])
+	case end-lt-1 != 1:
+		return malformed(fields[min(lt+1, len(fields)-1)])
+	}
+
+	module := func(f field) (Token, []string, bool) {
+		name, formals, ok := splitModule(f.text)
+		for _, formal := range formals {
+			ok = ok && formal != "" && isIdentStart(formal[0]) && strings.IndexFunc(formal, func(r rune) bool {
+				return r > unicode.MaxASCII || !isIdentStart(byte(r)) && !isDigit(byte(r))
+			}) < 0
+		}
+		return Token(name), formals, ok
+	}
+
+	var context ruleContext
+	var ok bool
+	context.Condition, context.conditionOffset = condition, conditionOffset
+	context.Predecessor, context.Formals, ok = module(fields[lt+1])
+	if !ok {
+		return malformed(fields[lt+1])
+	}
+	parametric := context.Formals != nil || condition != ""
+	appendModules := func(fields []field, tokens *[]Token, formals *[][]string) bool {
+		for _, f := range fields {
+			t, names, ok := module(f)
+			if !ok {
+				return false
+			}
+			*tokens = append(*tokens, t)
+			*formals = append(*formals, names)
+			context.modules = append(context.modules, f)
+			parametric = parametric || names != nil
+		}
+		return true
+	}
+	if !appendModules(fields[:max(lt, 0)], &context.Left, &context.LeftFormals) {
+		return malformed(fields[0])
+	}
+	if gt >= 0 && !appendModules(fields[gt+1:], &context.Right, &context.RightFormals) {
+		return malformed(fields[gt+1])
+	}
+	if !parametric {
+		context.LeftFormals, context.RightFormals = nil, nil
+	}
+	return context, nil
 }
 
 func ParseState(state string) []Token {
 	return symbolsToTokens(strings.Fields(state))
 }
 
+type field struct {
+	text   string
+	offset int
+}
+
+func (f field) trimmed() field {
+	trimmed := strings.TrimLeftFunc(f.text, unicode.IsSpace)
+	return field{
+		text:   strings.TrimRightFunc(trimmed, unicode.IsSpace),
+		offset: f.offset + len(f.text) - len(trimmed),
+	}
+}
+
+func splitGroups(str string) []field {
+	var groups []field
+	start := 0
+	for i := 0; i <= len(str); i++ {
+		if i == len(str) || str[i] == ';' {
+			groups = append(groups, field{text: str[start:i], offset: start})
+			start = i + 1
+		}
+	}
+	return groups
+}
+
+// splitFields splits str at whitespace outside of parentheses.
+func splitFields(str string, offset int) []field {
+	var fields []field
+	start, depth := -1, 0
+	for i, r := range str {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth = max(depth-1, 0)
+		}
+		if unicode.IsSpace(r) && depth == 0 {
+			if start >= 0 {
+				fields = append(fields, field{text: str[start:i], offset: offset + start})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, field{text: str[start:], offset: offset + start})
+	}
+	return fields
+}
+
+func position(str string, offset int) (line, column int) {
+	line = 1 + strings.Count(str[:offset], "\n")
+	column = offset - strings.LastIndexByte(str[:offset], '\n')
+	return line, column
+}
+
+func validToken(t string) bool {
+	for _, r := range t {
+		if !unicode.IsGraphic(r) || r == ';' {
+			return false
+		}
+	}
+	return true
+}
+
 func tryParseStatefulVariable(t Token) (variable string, num uint8, ok bool) {
 	var sb strings.Builder
 	cumulativeNumber := 0
@@ -9,7 +9,21 @@ import (
 type WeightedRule struct {
 	Probability float64
 	Catalyst    Token
-	Tokens      []Token
+	// Left and Right are the context the predecessor must appear in, nearest
+	// token last in Left and first in Right.
+	Left   []Token
+	Right  []Token
+	Tokens []Token
+
+	// Formals name the parameters of the predecessor, LeftFormals and
+	// RightFormals those of each context module. Condition guards the
+	// alternative and Arguments holds the argument expressions of each token
+	// in Tokens; all of them are empty for rules without parameters.
+	Formals      []string
+	LeftFormals  [][]string
+	RightFormals [][]string
+	Condition    string
+	Arguments    [][]string
 }
 
 type ProductionRule struct {
@@ -17,6 +31,10 @@ type ProductionRule struct {
 	Weights     []WeightedRule
 }
 
+// String writes the rule as "predecessor": `alternatives`, every alternative
+// as its probability, its catalyst and the key it was parsed from followed by
+// "->", then its successor, as in `0.50 *C B < A(t) > C : t > 1 -> F(t)`. The
+// key is left out when it is the bare predecessor.
 func (r *ProductionRule) String() string {
 	var sb strings.Builder
 	sb.WriteRune('"')
@@ -28,11 +46,17 @@ func (r *ProductionRule) String() string {
 		if wt.Catalyst != "" {
 			sb.WriteString(" *")
 			sb.WriteString(string(wt.Catalyst))
-			sb.WriteString(" -> ")
+		}
+		if key := wt.key(r.Predecessor); key != r.Predecessor {
+			sb.WriteString(" ")
+			sb.WriteString(string(key))
+			sb.WriteString(" ->")
+		} else if wt.Catalyst != "" {
+			sb.WriteString(" ->")
 		}
 		sb.WriteString(" ")
-		for _, t := range wt.Tokens {
-			sb.WriteString(string(t))
+		for k, t := range wt.Tokens {
+			sb.WriteString(moduleString(t, formalsAt(wt.Arguments, k)))
 			sb.WriteString(" ")
 		}
 		if i != len(r.Weights)-1 {
@@ -43,6 +67,43 @@ func (r *ProductionRule) String() string {
 	return sb.String()
 }
 
+// key returns the rule key wt was parsed from, with predecessor between its
+// left and right context.
+func (wt *WeightedRule) key(predecessor Token) Token {
+	var modules []string
+	for k, t := range wt.Left {
+		modules = append(modules, moduleString(t, formalsAt(wt.LeftFormals, k)))
+	}
+	if len(wt.Left) > 0 {
+		modules = append(modules, "<")
+	}
+	modules = append(modules, moduleString(predecessor, wt.Formals))
+	if len(wt.Right) > 0 {
+		modules = append(modules, ">")
+	}
+	for k, t := range wt.Right {
+		modules = append(modules, moduleString(t, formalsAt(wt.RightFormals, k)))
+	}
+	if wt.Condition != "" {
+		modules = append(modules, ":", wt.Condition)
+	}
+	return Token(strings.Join(modules, " "))
+}
+
+func moduleString(t Token, args []string) string {
+	if args == nil {
+		return string(t)
+	}
+	return string(t) + "(" + strings.Join(args, ",") + ")"
+}
+
+func formalsAt(formals [][]string, i int) []string {
+	if i >= len(formals) {
+		return nil
+	}
+	return formals[i]
+}
+
 func NewProductionRule(predecessor Token, weights []WeightedRule) ProductionRule {
 	return ProductionRule{
 		Predecessor: predecessor,
@@ -50,12 +111,12 @@ func NewProductionRule(predecessor Token, weights []WeightedRule) ProductionRule
 	}
 }
 
-func (r *ProductionRule) ChooseSuccessor() []Token {
+func (r *ProductionRule) ChooseSuccessor(rng *rand.Rand) []Token {
 	total := 0.0
 	for _, wt := range r.Weights {
 		total += wt.Probability
 	}
-	random := rand.Float64() * total
+	random := rng.Float64() * total
 	for _, wt := range r.Weights {
 		random -= wt.Probability
 		if random < 0 {
@@ -69,17 +130,40 @@ type ByteWeightedRule struct {
 	LowerLimit float64
 	UpperLimit float64
 	Catalyst   TokenStateId
+	Left       []TokenStateId
+	Right      []TokenStateId
 	Successor  []TokenStateId
+
+	// Formals is the number of predecessor arguments bound for Condition and
+	// Arguments, LeftFormals and RightFormals that of each context module.
+	Formals      int
+	LeftFormals  []int
+	RightFormals []int
+	Condition    *Expression
+	Arguments    [][]*Expression
+}
+
+func (wt *ByteWeightedRule) HasContext() bool {
+	return len(wt.Left) > 0 || len(wt.Right) > 0
+}
+
+func (wt *ByteWeightedRule) IsParametric() bool {
+	return wt.Formals > 0 || wt.LeftFormals != nil || wt.RightFormals != nil || wt.Condition != nil || wt.Arguments != nil
 }
 
 type ByteProductionRule struct {
 	Weights           []ByteWeightedRule
-	PreSampledWeights []uint8
-	currentIndex      int
+	PreSampledWeights []uint16
 	Predecessor       TokenStateId
+	// Contextual is set when any alternative has a left or right context,
+	// Parametric when any binds parameters, has a condition or arguments.
+	Contextual bool
+	Parametric bool
 }
 
-func (r *ProductionRule) EncodeTokens(tokenBytes map[Token]TokenStateId, presample bool) ByteProductionRule {
+const preSampleSize = 256
+
+func (r *ProductionRule) EncodeTokens(tokenBytes map[Token]TokenStateId, presample bool, rng *rand.Rand) ByteProductionRule {
 	rule := ByteProductionRule{
 		Weights:     make([]ByteWeightedRule, len(r.Weights), len(r.Weights)),
 		Predecessor: tokenBytes[r.Predecessor],
@@ -95,20 +179,68 @@ func (r *ProductionRule) EncodeTokens(tokenBytes map[Token]TokenStateId, presamp
 		}
 		rule.Weights[w] = ByteWeightedRule{
 			Catalyst:  tokenBytes[wt.Catalyst],
+			Left:      encodeContext(tokenBytes, wt.Left),
+			Right:     encodeContext(tokenBytes, wt.Right),
 			Successor: encodedTokens,
 		}
+		encodeParameters(&rule.Weights[w], &wt)
+		rule.Contextual = rule.Contextual || rule.Weights[w].HasContext()
+		rule.Parametric = rule.Parametric || rule.Weights[w].IsParametric()
 		rule.Weights[w].LowerLimit = total
 		total += wt.Probability
 		rule.Weights[w].UpperLimit = total
 	}
 
 	if presample {
-		rule.PreSample()
+		rule.PreSample(rng)
 	}
 	return rule
 }
 
-func (bp *ByteProductionRule) RandomizeWeights(delta float64, presample bool) {
+// encodeParameters compiles the expressions of wt. The parser has already
+// reported malformed expressions, any left are treated as always 0.
+func encodeParameters(encoded *ByteWeightedRule, wt *WeightedRule) {
+	names := parameterNames(wt.Formals, wt.LeftFormals, wt.RightFormals)
+	compile := func(src string) *Expression {
+		expression, err := CompileExpression(src, names)
+		if err != nil {
+			return &Expression{Source: src, root: constNode(0)}
+		}
+		return expression
+	}
+
+	encoded.Formals = len(wt.Formals)
+	for _, formals := range wt.LeftFormals {
+		encoded.LeftFormals = append(encoded.LeftFormals, len(formals))
+	}
+	for _, formals := range wt.RightFormals {
+		encoded.RightFormals = append(encoded.RightFormals, len(formals))
+	}
+	if wt.Condition != "" {
+		encoded.Condition = compile(wt.Condition)
+	}
+	if wt.Arguments != nil {
+		encoded.Arguments = make([][]*Expression, len(wt.Arguments))
+		for i, args := range wt.Arguments {
+			for _, arg := range args {
+				encoded.Arguments[i] = append(encoded.Arguments[i], compile(arg))
+			}
+		}
+	}
+}
+
+func encodeContext(tokenBytes map[Token]TokenStateId, tokens []Token) []TokenStateId {
+	if len(tokens) == 0 {
+		return nil
+	}
+	encoded := make([]TokenStateId, len(tokens))
+	for i, t := range tokens {
+		encoded[i] = tokenBytes[t]
+	}
+	return encoded
+}
+
+func (bp *ByteProductionRule) RandomizeWeights(rng *rand.Rand, delta float64, presample bool) {
 	currentWeights := make([]float64, len(bp.Weights), len(bp.Weights))
 	for i := 0; i < len(bp.Weights); i++ {
 		currentWeights[i] = bp.Weights[i].UpperLimit - bp.Weights[i].LowerLimit
@@ -116,7 +248,7 @@ func (bp *ByteProductionRule) RandomizeWeights(delta float64, presample bool) {
 
 	total := 0.0
 	for i := 0; i < len(bp.Weights); i++ {
-		currentWeights[i] += delta - rand.Float64()*2*delta
+		currentWeights[i] += delta - rng.Float64()*2*delta
 		currentWeights[i] = max(0, currentWeights[i])
 
 		bp.Weights[i].LowerLimit = total
@@ -124,51 +256,124 @@ func (bp *ByteProductionRule) RandomizeWeights(delta float64, presample bool) {
 		bp.Weights[i].UpperLimit = total
 	}
 	if presample {
-		bp.PreSample()
+		bp.PreSample(rng)
 	}
 }
 
-func (bp *ByteProductionRule) PreSample() {
-	if bp.Weights == nil || len(bp.Weights) == 0 {
+// PreSample draws the choices of bp in advance. Rules with context or
+// conditions are left alone, they choose among the alternatives that apply
+// every time, and so are rules whose weights are all zero, which always keep
+// the token.
+func (bp *ByteProductionRule) PreSample(rng *rand.Rand) {
+	if bp.Weights == nil || len(bp.Weights) == 0 || bp.Contextual || bp.conditional() {
+		return
+	}
+	if bp.Weights[len(bp.Weights)-1].UpperLimit == 0 {
+		bp.PreSampledWeights = nil
 		return
 	}
 	if bp.PreSampledWeights == nil {
-		bp.PreSampledWeights = make([]uint8, 256, 256)
+		bp.PreSampledWeights = make([]uint16, preSampleSize, preSampleSize)
 	}
-	for i := 0; i < 256; i++ {
-		random := rand.Float64() * (bp.Weights[len(bp.Weights)-1].UpperLimit)
+	for i := 0; i < preSampleSize; i++ {
+		random := rng.Float64() * (bp.Weights[len(bp.Weights)-1].UpperLimit)
 		index, _ := bp.findRuleByProbability(random)
 		bp.PreSampledWeights[i] = index
 	}
 }
 
-func (bp *ByteProductionRule) ChooseSuccessor(l *LSystem, previousToken TokenStateId) []TokenStateId {
-	emptyToken := l.EmptyTokenId
-	if previousToken.HasParam() {
-		previousToken = l.ParamToByte[previousToken]
+func (bp *ByteProductionRule) conditional() bool {
+	for i := range bp.Weights {
+		if bp.Weights[i].Condition != nil {
+			return true
+		}
 	}
+	return false
+}
 
+// ChooseSuccessor picks an alternative using random, a uniformly distributed
+// value, so that the choice only depends on the caller's source of randomness.
+func (bp *ByteProductionRule) ChooseSuccessor(l *LSystem, previousToken TokenStateId, random uint64) []TokenStateId {
+	alt, blocked := bp.chooseIndex(l, previousToken, random)
+	if alt < 0 || blocked {
+		return []TokenStateId{bp.Predecessor}
+	}
+	return bp.Weights[alt].Successor
+}
+
+// chooseIndex is ChooseSuccessor returning the index of the alternative, -1
+// when all weights are zero, and whether its catalyst blocked it.
+func (bp *ByteProductionRule) chooseIndex(l *LSystem, previousToken TokenStateId, random uint64) (int, bool) {
+	alt := -1
 	if bp.PreSampledWeights != nil {
-		rule := bp.Weights[bp.PreSampledWeights[bp.currentIndex]]
-		bp.currentIndex++
-		if bp.currentIndex == len(bp.PreSampledWeights) {
-			bp.currentIndex = 0
+		alt = int(bp.PreSampledWeights[random%preSampleSize])
+	} else if index, rule := bp.findRuleByProbability(unitFloat(random) * (bp.Weights[len(bp.Weights)-1].UpperLimit)); rule.Successor != nil {
+		alt = int(index)
+	}
+	if alt < 0 {
+		return -1, false
+	}
+	return alt, !l.catalystAllows(bp.Weights[alt].Catalyst, previousToken)
+}
+
+// chooseAlternative picks among the alternatives that apply to the token at
+// index of the generation: their context must match and their condition must
+// hold. Matching contextual alternatives take precedence over context-free
+// ones. It returns -1 when no alternative applies, otherwise the chosen
+// alternative, whether its catalyst blocked it and env holding the parameters
+// bound for it.
+func (bp *ByteProductionRule) chooseAlternative(l *LSystem, gen *generationView, index int, previousToken TokenStateId, random uint64, env []float64) (int, bool, []float64) {
+	if bp.PreSampledWeights != nil && !bp.Contextual {
+		// all alternatives apply, the pre-sampled choice stands
+		alt, blocked := bp.chooseIndex(l, previousToken, random)
+		if alt >= 0 {
+			env, _ = l.bind(gen, index, &bp.Weights[alt], env[:0])
 		}
-		if rule.Catalyst == emptyToken || rule.Catalyst == previousToken {
-			return rule.Successor
+		return alt, blocked, env
+	}
+	applies := func(wt *ByteWeightedRule, contextual bool) bool {
+		if wt.HasContext() != contextual {
+			return false
 		}
-		return []TokenStateId{bp.Predecessor}
+		var matched bool
+		env, matched = l.bind(gen, index, wt, env[:0])
+		return matched && (wt.Condition == nil || wt.Condition.Eval(env) != 0)
 	}
-	random := rand.Float64() * (bp.Weights[len(bp.Weights)-1].UpperLimit)
-	_, rule := bp.findRuleByProbability(random)
 
-	if rule.Catalyst == emptyToken || rule.Catalyst == previousToken {
-		return rule.Successor
+	contextual := bp.Contextual
+	total := 0.0
+	for {
+		for i := range bp.Weights {
+			if applies(&bp.Weights[i], contextual) {
+				total += bp.Weights[i].UpperLimit - bp.Weights[i].LowerLimit
+			}
+		}
+		if total > 0 || !contextual {
+			break
+		}
+		contextual = false
+	}
+	if total == 0 {
+		return -1, false, env
+	}
+
+	p := unitFloat(random) * total
+	chosen := -1
+	for i := range bp.Weights {
+		wt := &bp.Weights[i]
+		if wt.UpperLimit == wt.LowerLimit || !applies(wt, contextual) {
+			continue
+		}
+		chosen = i
+		p -= wt.UpperLimit - wt.LowerLimit
+		if p < 0 {
+			break
+		}
 	}
-	return []TokenStateId{bp.Predecessor}
+	return chosen, !l.catalystAllows(bp.Weights[chosen].Catalyst, previousToken), env
 }
 
-func (bp *ByteProductionRule) findRuleByProbability(p float64) (uint8, ByteWeightedRule) {
+func (bp *ByteProductionRule) findRuleByProbability(p float64) (uint16, ByteWeightedRule) {
 	// Use binary search to find the successor
 	lo, hi := 0, len(bp.Weights)
 	for lo < hi {
@@ -178,13 +383,13 @@ func (bp *ByteProductionRule) findRuleByProbability(p float64) (uint8, ByteWeigh
 		} else if p >= bp.Weights[mid].UpperLimit {
 			lo = mid + 1
 		} else {
-			return uint8(mid), bp.Weights[mid]
+			return uint16(mid), bp.Weights[mid]
 		}
 	}
 	return 0, ByteWeightedRule{}
 }
 
-func (bp *ByteProductionRule) String(tokens [255]Token) string {
+func (bp *ByteProductionRule) String(tokens []Token) string {
 	var sb strings.Builder
 	sb.WriteRune('"')
 	for i, wt := range bp.Weights {
@@ -194,7 +399,7 @@ func (bp *ByteProductionRule) String(tokens [255]Token) string {
 		sb.WriteString(strconv.FormatFloat(wt.UpperLimit-wt.LowerLimit, 'f', 2, 64))
 		sb.WriteString(" ")
 		for i, t := range wt.Successor {
-			sb.WriteString(string(tokens[t]))
+			sb.WriteString(string(tokens[t.TokenId()]))
 			if i != len(wt.Successor)-1 {
 				sb.WriteString(" ")
 			}
@@ -0,0 +1,42 @@
+package lsystem
+
+import "pgregory.net/rand"
+
+// Randomness used while rewriting is derived from the seed, the generation and
+// the position of the rewritten token, so a derivation does not depend on how
+// the work is split between goroutines.
+
+func splitMix(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+func generationSeed(seed uint64, generation int) uint64 {
+	return splitMix(seed + uint64(generation)*0x9E3779B97F4A7C15)
+}
+
+func positionSample(generationSeed uint64, index int) uint64 {
+	return splitMix(generationSeed + uint64(index)*0xC2B2AE3D27D4EB4F)
+}
+
+// unitFloat maps a random value to [0, 1).
+func unitFloat(random uint64) float64 {
+	return float64(random>>11) / (1 << 53)
+}
+
+func tokenHash(t Token) uint64 {
+	// FNV-1a
+	h := uint64(0xcbf29ce484222325)
+	for i := 0; i < len(t); i++ {
+		h ^= uint64(t[i])
+		h *= 0x100000001b3
+	}
+	return h
+}
+
+// ruleRand returns the generator used to pre-sample the rule of t. It does not
+// depend on the order in which rules are encoded.
+func (l *LSystem) ruleRand(t Token) *rand.Rand {
+	return rand.New(l.seed, tokenHash(t))
+}
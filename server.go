@@ -0,0 +1,340 @@
+package lsystem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves the production rate analysis of an LSystem over HTTP:
+//
+//	/stats           growth statistics of every rule as JSON
+//	/charts          charts of every rule as HTML
+//	/charts/{token}  the chart of a single rule, "LSystem" for the whole system
+//	/growth          charts of the growth per generation as HTML, see AnalyseGrowth
+//	/rules           how often every alternative fired as JSON, see RuleCounts
+//	/rules/chart     the same as an HTML chart
+//
+// The query parameters runs, samples, generations and seed re-run the
+// analysis with the given AnalysisOptions Runs, Samples, Iterations and Seed.
+// Without them the analysis done on the first request is reused. The growth
+// charts and rule counts follow Samples generations unless generations is
+// given, rule counts are taken from a single derivation with the seed of the
+// LSystem.
+//
+// Analyses stop when the client goes away or the server shuts down, and after
+// maxQueryTime.
+type Server struct {
+	l    *LSystem
+	opts AnalysisOptions
+
+	mu    sync.Mutex
+	rates map[Token]ProductionRate
+	// analysing is closed once the analysis to be reused in flight ends
+	analysing chan struct{}
+}
+
+// Limits on the query parameters and on the time an analysis run for a request
+// may take, so that a request cannot keep the server busy for long.
+const (
+	maxQueryRuns    = 20
+	maxQuerySamples = 500
+	maxQueryTime    = 30 * time.Second
+)
+
+func NewServer(l *LSystem, opts AnalysisOptions) *Server {
+	return &Server{l: l, opts: opts}
+}
+
+// Handler returns the handler serving the endpoints of s, for mounting in
+// another mux with http.StripPrefix.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handle(s.serveStats))
+	mux.HandleFunc("/charts", s.handle(s.serveCharts))
+	mux.HandleFunc("/charts/", s.handle(s.serveCharts))
+	mux.HandleFunc("/growth", s.handle(s.serveGrowth))
+	mux.HandleFunc("/rules", s.handle(s.serveRules))
+	mux.HandleFunc("/rules/chart", s.handle(s.serveRules))
+	return mux
+}
+
+// ListenAndServe serves s on addr until ctx is done, then shuts the server down
+// gracefully, waiting up to 5 seconds for requests in flight.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-failed; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// httpError is an error with the status code it is answered with.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// handle answers the errors of fn, and any panic, with a JSON error message.
+func (s *Server) handle(fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("panic: %v", p)
+				}
+			}()
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				return &httpError{http.StatusMethodNotAllowed, errors.New("method not allowed")}
+			}
+			return fn(w, r)
+		}()
+		if err == nil {
+			return
+		}
+		status := http.StatusInternalServerError
+		var httpErr *httpError
+		if errors.As(err, &httpErr) {
+			status = httpErr.status
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusServiceUnavailable
+			err = fmt.Errorf("analysis took longer than %v, try fewer runs, samples or generations", maxQueryTime)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+	}
+}
+
+// options returns the options of s overridden by the query of r, and whether
+// the query overrides any.
+func (s *Server) options(r *http.Request) (AnalysisOptions, bool, error) {
+	query := r.URL.Query()
+	opts := s.opts
+	custom := false
+	for _, param := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{"runs", &opts.Runs, maxQueryRuns},
+		{"samples", &opts.Samples, maxQuerySamples},
+		{"generations", &opts.Iterations, maxQuerySamples},
+	} {
+		if !query.Has(param.name) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param.name))
+		if err != nil || n < 0 || n > param.max {
+			return opts, false, &httpError{http.StatusBadRequest, fmt.Errorf("%s must be a number from 0 to %d", param.name, param.max)}
+		}
+		*param.value = n
+		custom = true
+	}
+	if query.Has("seed") {
+		seed, err := strconv.ParseUint(query.Get("seed"), 10, 64)
+		if err != nil {
+			return opts, false, &httpError{http.StatusBadRequest, errors.New("seed must be an unsigned number")}
+		}
+		opts.Seed = seed
+		custom = true
+	}
+	return opts, custom, nil
+}
+
+// queryContext returns the context of r limited to maxQueryTime.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), maxQueryTime)
+}
+
+// analysis returns the production rates for the query of r.
+func (s *Server) analysis(r *http.Request) (map[Token]ProductionRate, error) {
+	opts, custom, err := s.options(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	if custom {
+		return s.l.AnalyseProductionRatesContext(ctx, opts)
+	}
+
+	for {
+		s.mu.Lock()
+		rates, analysing := s.rates, s.analysing
+		if rates == nil && analysing == nil {
+			s.analysing = make(chan struct{})
+		}
+		s.mu.Unlock()
+		if rates != nil {
+			return rates, nil
+		}
+		if analysing == nil {
+			return s.analyse(ctx)
+		}
+		// another request is analysing, an analysis cut short is started over
+		select {
+		case <-analysing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// analyse runs the analysis to be reused, keeping it unless it was cut short.
+func (s *Server) analyse(ctx context.Context) (map[Token]ProductionRate, error) {
+	rates, err := s.l.AnalyseProductionRatesContext(ctx, s.opts)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.rates = rates
+	}
+	close(s.analysing)
+	s.analysing = nil
+	return rates, err
+}
+
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) error {
+	rates, err := s.analysis(r)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(RateReports(rates)); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+	return nil
+}
+
+func (s *Server) serveCharts(w http.ResponseWriter, r *http.Request) error {
+	rates, err := s.analysis(r)
+	if err != nil {
+		return err
+	}
+	tokens := sortedRateTokens(rates)
+	if token, ok := strings.CutPrefix(r.URL.Path, "/charts/"); ok && token != "" {
+		if _, exists := rates[Token(token)]; !exists {
+			return &httpError{http.StatusNotFound, fmt.Errorf("no rule for %q", token)}
+		}
+		tokens = []Token{Token(token)}
+	}
+
+	page := components.NewPage()
+	page.PageTitle = "Production Rate Analysis"
+	for _, token := range tokens {
+		rate := rates[token]
+		page.AddCharts(rate.chart())
+	}
+	// rendered completely first, so that errors can still be answered
+	var buf bytes.Buffer
+	if err := page.Render(&buf); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+	return nil
+}
+
+// generations returns the options for r and the number of generations to
+// follow.
+func (s *Server) generations(r *http.Request) (AnalysisOptions, int, error) {
+	opts, _, err := s.options(r)
+	if err != nil {
+		return opts, 0, err
+	}
+	opts = opts.withDefaults()
+	if r.URL.Query().Has("generations") {
+		return opts, opts.Iterations, nil
+	}
+	return opts, opts.Samples, nil
+}
+
+func (s *Server) serveGrowth(w http.ResponseWriter, r *http.Request) error {
+	opts, generations, err := s.generations(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	series, err := s.l.AnalyseGrowthContext(ctx, generations, opts)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := series.Render(&buf); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+	return nil
+}
+
+func (s *Server) serveRules(w http.ResponseWriter, r *http.Request) error {
+	opts, generations, err := s.generations(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	// the counts of the generations derived before the limit still hold
+	report, err := s.l.report(ctx, generations, opts.MaxTokens)
+	if err != nil && !errors.Is(err, ErrTokenLimit) && !errors.Is(err, ErrMemoryLimit) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if r.URL.Path == "/rules/chart" {
+		err = alternativesChart(report.Alternatives).Render(&buf)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		err = json.NewEncoder(&buf).Encode(report.Alternatives)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err != nil {
+		return err
+	}
+	buf.WriteTo(w)
+	return nil
+}
+
+func sortedRateTokens(rates map[Token]ProductionRate) []Token {
+	tokens := make([]Token, 0, len(rates))
+	for token := range rates {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	return tokens
+}
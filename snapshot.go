@@ -0,0 +1,144 @@
+package lsystem
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrSnapshotMismatch = errors.New("snapshot does not match the rules")
+
+// Snapshot is the state of an LSystem between two generations. Randomness is
+// derived from the seed, the generation and the position of every token, so
+// together with the rule weights and their pre-sampled choices the tokens are
+// all it takes to continue the derivation exactly as it would have gone on.
+type Snapshot struct {
+	Seed       uint64
+	Generation int
+	TokenStream
+	Rules []RuleState
+}
+
+// RuleState holds the weights of the rule of Token as UpperLimit of every
+// alternative, and its pre-sampled choices, which RandomizeWeights or SetSeed
+// may have changed since the rules were parsed.
+type RuleState struct {
+	Token      Token
+	Limits     []float64
+	PreSampled []uint16
+}
+
+// Snapshot captures the current generation of l.
+func (l *LSystem) Snapshot() *Snapshot {
+	s := &Snapshot{Seed: l.seed, Generation: l.generation, TokenStream: *l.Stream()}
+	for id, rule := range l.ByteRules {
+		if rule.Weights == nil {
+			continue
+		}
+		state := RuleState{Token: l.BytesToken[id], Limits: make([]float64, len(rule.Weights))}
+		for k, wt := range rule.Weights {
+			state.Limits[k] = wt.UpperLimit
+		}
+		state.PreSampled = append([]uint16(nil), rule.PreSampledWeights...)
+		s.Rules = append(s.Rules, state)
+	}
+	return s
+}
+
+// Restore makes s the current generation of l, whose rules must be those s
+// was taken with, and seeds l with the seed of s. Restoring the same snapshot
+// into several systems and reseeding them branches variants off a shared
+// prefix. Tracing and rule counts start over at the restored generation.
+func (l *LSystem) Restore(s *Snapshot) error {
+	tokens, err := l.MapStream(&s.TokenStream)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshotMismatch, err)
+	}
+	if s.Args != nil && (!l.parametric || len(s.Args) != len(s.Tokens)) {
+		return fmt.Errorf("%w: unexpected arguments", ErrSnapshotMismatch)
+	}
+	for _, state := range s.Rules {
+		id, exists := l.TokenBytes[state.Token]
+		if !exists || len(l.ByteRules[id.TokenId()].Weights) != len(state.Limits) {
+			return fmt.Errorf("%w: rule %q differs", ErrSnapshotMismatch, state.Token)
+		}
+		if state.PreSampled != nil && len(state.PreSampled) != preSampleSize {
+			return fmt.Errorf("%w: rule %q differs", ErrSnapshotMismatch, state.Token)
+		}
+		for _, alt := range state.PreSampled {
+			if int(alt) >= len(state.Limits) {
+				return fmt.Errorf("%w: rule %q differs", ErrSnapshotMismatch, state.Token)
+			}
+		}
+	}
+
+	l.seed = s.Seed
+	for _, state := range s.Rules {
+		rule := &l.ByteRules[l.TokenBytes[state.Token].TokenId()]
+		lower := 0.0
+		for k, upper := range state.Limits {
+			rule.Weights[k].LowerLimit, rule.Weights[k].UpperLimit = lower, upper
+			lower = upper
+		}
+		rule.PreSampledWeights = append([]uint16(nil), state.PreSampled...)
+	}
+	l.Reset()
+	l.generation = s.Generation
+	l.MemPool.Reset()
+	buf := l.MemPool.GetReadBuffer(0)
+	for i, t := range tokens {
+		var args []float64
+		if s.Args != nil {
+			args = s.Args[i]
+		}
+		buf.AppendModule(t, args)
+	}
+	return nil
+}
+
+// WriteTo writes s in a compact binary format: the seed, the generation, the
+// tokens as written by TokenStream.WriteTo and the rule states.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	b := appendHeader(nil, snapshotMagic, snapshotVersion)
+	b = binary.LittleEndian.AppendUint64(b, s.Seed)
+	b = binary.AppendUvarint(b, uint64(s.Generation))
+	b, err := appendStream(b, &s.TokenStream)
+	if err != nil {
+		return 0, err
+	}
+	b = appendList(b, s.Rules, func(b []byte, state RuleState) []byte {
+		b = appendString(b, string(state.Token))
+		b = appendList(b, state.Limits, appendFloat)
+		return appendList(b, state.PreSampled, binary.LittleEndian.AppendUint16)
+	})
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadSnapshot reads a snapshot written by Snapshot.WriteTo.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	d := newDecoder(r)
+	if err := d.header(snapshotMagic, snapshotVersion); err != nil {
+		return nil, err
+	}
+	s := &Snapshot{Seed: d.uint64(), Generation: d.int(math.MaxInt32)}
+	if ts := d.stream(); ts != nil {
+		s.TokenStream = *ts
+	}
+	s.Rules = readList(d, len(s.Alphabet), func() RuleState {
+		state := RuleState{Token: d.token(), Limits: readList(d, math.MaxUint16, d.float)}
+		state.PreSampled = readList(d, preSampleSize, d.uint16)
+		for _, alt := range state.PreSampled {
+			if int(alt) >= len(state.Limits) {
+				d.fail()
+			}
+		}
+		return state
+	})
+	if d.err != nil {
+		return nil, d.err
+	}
+	return s, nil
+}
@@ -1,7 +1,30 @@
 package lsystem
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Token string
 
+// Module is a token together with the arguments of a parametric module.
+type Module struct {
+	Token Token
+	Args  []float64
+}
+
+func (m Module) String() string {
+	if len(m.Args) == 0 {
+		return string(m.Token)
+	}
+	args := make([]string, len(m.Args))
+	for i, arg := range m.Args {
+		args[i] = strconv.FormatFloat(arg, 'g', -1, 64)
+	}
+	return string(m.Token) + "(" + strings.Join(args, ",") + ")"
+}
+
 type TokenSet map[Token]struct{}
 
 func (ts TokenSet) Contains(t Token) bool {
@@ -20,3 +43,10 @@ func (ts TokenSet) AsSlice() []Token {
 	}
 	return slice
 }
+
+// Sorted returns the tokens of ts in ascending order.
+func (ts TokenSet) Sorted() []Token {
+	slice := ts.AsSlice()
+	sort.Slice(slice, func(i, j int) bool { return slice[i] < slice[j] })
+	return slice
+}
@@ -0,0 +1,160 @@
+package lsystem
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Derivation records how a token of a generation was rewritten. Alternative
+// indexes the Weights of the token's rule and is -1 when the token has no
+// rule or none of its alternatives applied. Blocked is set when the catalyst
+// of the alternative did not match, in which case the token was kept.
+type Derivation struct {
+	Token       TokenStateId
+	Alternative int32
+	Blocked     bool
+	Successors  int32
+}
+
+// WithTracing records a Derivation for every token rewritten, see Trace.
+// It costs memory proportional to all generations derived.
+func WithTracing() Option {
+	return func(l *LSystem) {
+		l.traceEnabled = true
+	}
+}
+
+func (l *LSystem) startTrace(gen *generationView) {
+	if l.traceEnabled {
+		l.tracing = make([]Derivation, gen.len)
+	}
+}
+
+// Trace is the derivation tree of the current generation: every token of
+// generation g+1 was produced by exactly one token of generation g.
+type Trace struct {
+	l *LSystem
+	// Generations[g][i] tells how token i of generation g was rewritten.
+	Generations [][]Derivation
+	// starts[g][i] is the position in generation g+1 of the first successor of
+	// token i of generation g, followed by the length of generation g+1.
+	starts [][]int
+	last   []TokenStateId
+}
+
+// Trace returns the derivations recorded since the last Reset, nil unless
+// tracing is enabled.
+func (l *LSystem) Trace() *Trace {
+	if !l.traceEnabled {
+		return nil
+	}
+	t := &Trace{l: l, Generations: l.trace, starts: make([][]int, len(l.trace)), last: l.MemPool.ReadAll()}
+	for g, derivations := range l.trace {
+		starts := make([]int, len(derivations)+1)
+		for i, d := range derivations {
+			starts[i+1] = starts[i] + int(d.Successors)
+		}
+		t.starts[g] = starts
+	}
+	return t
+}
+
+// TraceNode is a token of a generation together with how it was rewritten.
+// The tokens of the current generation have no Derivation yet and report
+// Alternative -1.
+type TraceNode struct {
+	Generation  int
+	Position    int
+	Token       Token
+	Alternative int
+	Blocked     bool
+}
+
+// Depth returns the number of generations traced.
+func (t *Trace) Depth() int {
+	return len(t.Generations)
+}
+
+// Len returns the number of tokens of generation g.
+func (t *Trace) Len(g int) int {
+	if g == len(t.Generations) {
+		return len(t.last)
+	}
+	return len(t.Generations[g])
+}
+
+// Node returns the token at position of generation g.
+func (t *Trace) Node(g, position int) TraceNode {
+	node := TraceNode{Generation: g, Position: position, Alternative: -1}
+	if g == len(t.Generations) {
+		node.Token = t.l.BytesToken[t.last[position].TokenId()]
+		return node
+	}
+	d := t.Generations[g][position]
+	node.Token = t.l.BytesToken[d.Token.TokenId()]
+	node.Alternative = int(d.Alternative)
+	node.Blocked = d.Blocked
+	return node
+}
+
+// Children returns the positions [from, to) in generation g+1 of the tokens
+// produced by the token at position of generation g.
+func (t *Trace) Children(g, position int) (from, to int) {
+	if g >= len(t.Generations) {
+		return 0, 0
+	}
+	return t.starts[g][position], t.starts[g][position+1]
+}
+
+// Parent returns the position in generation g-1 of the token that produced
+// the token at position of generation g, or -1 for the axiom.
+func (t *Trace) Parent(g, position int) int {
+	if g == 0 {
+		return -1
+	}
+	starts := t.starts[g-1]
+	return sort.Search(len(starts)-1, func(i int) bool { return starts[i+1] > position })
+}
+
+// WriteDOT writes the derivation tree as a Graphviz graph with one row per
+// generation. Edges are labelled with the alternative that fired, tokens kept
+// because of a catalyst are drawn in red.
+func (t *Trace) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	id := func(g, i int) string {
+		return "n" + strconv.Itoa(g) + "_" + strconv.Itoa(i)
+	}
+
+	bw.WriteString("digraph derivation {\n\tnode [shape=box];\n")
+	for g := 0; g <= t.Depth(); g++ {
+		bw.WriteString("\t{ rank=same;")
+		for i := 0; i < t.Len(g); i++ {
+			node := t.Node(g, i)
+			bw.WriteString(" " + id(g, i) + " [label=" + strconv.Quote(string(node.Token)))
+			if node.Blocked {
+				bw.WriteString(" color=red")
+			}
+			bw.WriteString("];")
+		}
+		bw.WriteString(" }\n")
+	}
+	for g := 0; g < t.Depth(); g++ {
+		for i := 0; i < t.Len(g); i++ {
+			node := t.Node(g, i)
+			from, to := t.Children(g, i)
+			for c := from; c < to; c++ {
+				bw.WriteString("\t" + id(g, i) + " -> " + id(g+1, c))
+				if node.Alternative >= 0 && !node.Blocked {
+					bw.WriteString(" [label=\"#" + strconv.Itoa(node.Alternative) + "\"]")
+				} else {
+					bw.WriteString(" [style=dashed]")
+				}
+				bw.WriteString(";\n")
+			}
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
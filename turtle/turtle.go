@@ -0,0 +1,204 @@
+// Package turtle interprets the tokens of an LSystem as turtle graphics
+// commands and renders the resulting drawing as SVG.
+package turtle
+
+import (
+	"bufio"
+	"github.com/viktordanov/lsystem"
+	"io"
+	"math"
+	"strconv"
+)
+
+type Command int
+
+const (
+	None Command = iota
+	// Forward draws a line, its argument overrides the step length.
+	Forward
+	// Move moves without drawing, its argument overrides the step length.
+	Move
+	// TurnLeft and TurnRight turn by the angle or by their argument in degrees.
+	TurnLeft
+	TurnRight
+	TurnAround
+	Push
+	Pop
+	// SetWidth sets the pen width to its argument, or multiplies the width
+	// by WidthFactor when it has none.
+	SetWidth
+	// SetColor selects the palette entry given by its argument, or the next
+	// one when it has none.
+	SetColor
+)
+
+type Config struct {
+	Commands map[lsystem.Token]Command
+	// Step is the default length of Forward and Move, Angle the default turn
+	// in degrees and Heading the initial direction, 90 pointing up.
+	Step    float64
+	Angle   float64
+	Heading float64
+
+	Width       float64
+	WidthFactor float64
+	Palette     []string
+	Background  string
+	// Margin is added around the drawing, in drawing units.
+	Margin float64
+}
+
+// DefaultConfig uses the ABOP alphabet: F draws, f moves, + and - turn,
+// | turns around, [ and ] push and pop, ! narrows the pen and ' changes colour.
+func DefaultConfig() Config {
+	return Config{
+		Commands: map[lsystem.Token]Command{
+			"F": Forward,
+			"G": Forward,
+			"f": Move,
+			"+": TurnLeft,
+			"-": TurnRight,
+			"|": TurnAround,
+			"[": Push,
+			"]": Pop,
+			"!": SetWidth,
+			"'": SetColor,
+		},
+		Step:        10,
+		Angle:       90,
+		Heading:     90,
+		Width:       1,
+		WidthFactor: 0.7,
+		Palette:     []string{"#2f4f2f", "#556b2f", "#6b8e23", "#9acd32"},
+		Margin:      10,
+	}
+}
+
+// Segment is a line drawn by the turtle.
+type Segment struct {
+	X1, Y1, X2, Y2 float64
+	Width          float64
+	Color          int
+}
+
+type state struct {
+	x, y, heading float64
+	width         float64
+	color         int
+}
+
+// Walk interprets the current tokens of l and calls fn for every segment
+// drawn. Tokens are read straight from the encoded buffers.
+func Walk(l *lsystem.LSystem, cfg Config, fn func(Segment)) {
+	commands := make([]Command, len(l.BytesToken))
+	for id, t := range l.BytesToken {
+		commands[id] = cfg.Commands[t]
+	}
+
+	current := state{heading: cfg.Heading, width: cfg.Width}
+	var stack []state
+	arg := func(args []float64, fallback float64) float64 {
+		if len(args) > 0 {
+			return args[0]
+		}
+		return fallback
+	}
+
+	l.Walk(func(t lsystem.TokenStateId, args []float64) bool {
+		switch commands[t.TokenId()] {
+		case Forward, Move:
+			step := arg(args, cfg.Step)
+			rad := current.heading * math.Pi / 180
+			x, y := current.x+step*math.Cos(rad), current.y+step*math.Sin(rad)
+			if commands[t.TokenId()] == Forward {
+				fn(Segment{X1: current.x, Y1: current.y, X2: x, Y2: y, Width: current.width, Color: current.color})
+			}
+			current.x, current.y = x, y
+		case TurnLeft:
+			current.heading += arg(args, cfg.Angle)
+		case TurnRight:
+			current.heading -= arg(args, cfg.Angle)
+		case TurnAround:
+			current.heading += 180
+		case Push:
+			stack = append(stack, current)
+		case Pop:
+			if len(stack) > 0 {
+				current = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case SetWidth:
+			current.width = arg(args, current.width*cfg.WidthFactor)
+		case SetColor:
+			current.color = int(arg(args, float64(current.color+1)))
+		}
+		return true
+	})
+}
+
+type Bounds struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+// Measure returns the bounding box of everything drawn for l.
+func Measure(l *lsystem.LSystem, cfg Config) Bounds {
+	b := Bounds{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+	Walk(l, cfg, func(s Segment) {
+		b.MinX = min(b.MinX, s.X1, s.X2)
+		b.MinY = min(b.MinY, s.Y1, s.Y2)
+		b.MaxX = max(b.MaxX, s.X1, s.X2)
+		b.MaxY = max(b.MaxY, s.Y1, s.Y2)
+	})
+	if b.MinX > b.MaxX {
+		return Bounds{}
+	}
+	return b
+}
+
+// RenderSVG draws the current tokens of l as SVG. The tokens are walked twice,
+// once to fit the viewBox and once to write the paths, so memory use does not
+// depend on the number of tokens. Connected segments sharing a pen are
+// written as a single path.
+func RenderSVG(w io.Writer, l *lsystem.LSystem, cfg Config) error {
+	b := Measure(l, cfg)
+	bw := bufio.NewWriter(w)
+	num := func(v float64) string {
+		// adding 0 turns -0 into 0
+		return strconv.FormatFloat(math.Round(v*1e4)/1e4+0, 'f', -1, 64)
+	}
+
+	// SVG's y axis points down, so the drawing is flipped.
+	bw.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="`)
+	bw.WriteString(num(b.MinX-cfg.Margin) + " " + num(-b.MaxY-cfg.Margin) + " ")
+	bw.WriteString(num(b.MaxX-b.MinX+2*cfg.Margin) + " " + num(b.MaxY-b.MinY+2*cfg.Margin) + `">` + "\n")
+	if cfg.Background != "" {
+		bw.WriteString(`<rect x="` + num(b.MinX-cfg.Margin) + `" y="` + num(-b.MaxY-cfg.Margin) + `" width="100%" height="100%" fill="` + cfg.Background + `"/>` + "\n")
+	}
+
+	open := false
+	var last Segment
+	closePath := func() {
+		if open {
+			bw.WriteString(`"/>` + "\n")
+			open = false
+		}
+	}
+	Walk(l, cfg, func(s Segment) {
+		connected := open && s.X1 == last.X2 && s.Y1 == last.Y2 && s.Width == last.Width && s.Color == last.Color
+		if !connected {
+			closePath()
+			color := "black"
+			if len(cfg.Palette) > 0 {
+				color = cfg.Palette[((s.Color%len(cfg.Palette))+len(cfg.Palette))%len(cfg.Palette)]
+			}
+			bw.WriteString(`<path fill="none" stroke-linecap="round" stroke="` + color + `" stroke-width="` + num(s.Width) + `" d="M` + num(s.X1) + " " + num(-s.Y1))
+			open = true
+		}
+		bw.WriteString(" L" + num(s.X2) + " " + num(-s.Y2))
+		last = s
+	})
+	closePath()
+
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
@@ -0,0 +1,37 @@
+package turtle
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/viktordanov/lsystem"
+	"strings"
+	"testing"
+)
+
+func TestRenderSVG(t *testing.T) {
+	vars, consts, rules := lsystem.ParseRules(map[lsystem.Token]string{
+		"S": `1 F [ + F ] f F(5) ! F`,
+	})
+	ls := lsystem.NewLSystem("S", rules, vars, consts, false)
+	ls.IterateOnce()
+
+	cfg := DefaultConfig()
+	cfg.Margin = 0
+	assert.Equal(t, Bounds{MinX: -10, MinY: 0, MaxX: 0, MaxY: 35}, roundBounds(Measure(ls, cfg)))
+
+	var buf bytes.Buffer
+	assert.NoError(t, RenderSVG(&buf, ls, cfg))
+	svg := buf.String()
+	assert.Contains(t, svg, `viewBox="-10 -35 10 35"`)
+	assert.Equal(t, 3, strings.Count(svg, "<path"))
+	assert.Contains(t, svg, `d="M0 0 L0 -10 L-10 -10"`)
+	assert.Contains(t, svg, `d="M0 -20 L0 -25"`)
+	assert.Contains(t, svg, `stroke-width="0.7" d="M0 -25 L0 -35"`)
+}
+
+func roundBounds(b Bounds) Bounds {
+	round := func(v float64) float64 {
+		return float64(int(v*1000)) / 1000
+	}
+	return Bounds{round(b.MinX), round(b.MinY), round(b.MaxX), round(b.MaxY)}
+}
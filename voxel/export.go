@@ -0,0 +1,119 @@
+package voxel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"io"
+	"strconv"
+)
+
+var ErrTooLarge = errors.New("grid exceeds 256 cells along an axis")
+
+// WriteVOX writes g as a single MagicaVoxel model, translated so that its
+// minimum corner is at the origin. palette[i] is the colour of material i+1;
+// a nil palette uses DefaultPalette.
+func WriteVOX(w io.Writer, g *Grid, palette []color.RGBA) error {
+	size := g.Size()
+	if size.X > 256 || size.Y > 256 || size.Z > 256 {
+		return ErrTooLarge
+	}
+	if palette == nil {
+		palette = DefaultPalette()
+	}
+
+	voxels := g.Voxels()
+	xyzi := make([]byte, 4, 4+4*len(voxels))
+	binary.LittleEndian.PutUint32(xyzi, uint32(len(voxels)))
+	for _, v := range voxels {
+		xyzi = append(xyzi, byte(v.X-g.Min.X), byte(v.Y-g.Min.Y), byte(v.Z-g.Min.Z), v.Material)
+	}
+
+	rgba := make([]byte, 256*4)
+	for i := 0; i < 256 && i < len(palette); i++ {
+		c := palette[i]
+		copy(rgba[i*4:], []byte{c.R, c.G, c.B, c.A})
+	}
+
+	sizeContent := make([]byte, 12)
+	binary.LittleEndian.PutUint32(sizeContent[0:], uint32(size.X))
+	binary.LittleEndian.PutUint32(sizeContent[4:], uint32(size.Y))
+	binary.LittleEndian.PutUint32(sizeContent[8:], uint32(size.Z))
+
+	children := chunk(nil, "SIZE", sizeContent)
+	children = chunk(children, "XYZI", xyzi)
+	children = chunk(children, "RGBA", rgba)
+
+	out := []byte("VOX ")
+	out = binary.LittleEndian.AppendUint32(out, 150)
+	out = append(out, "MAIN"...)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(children)))
+	out = append(out, children...)
+	_, err := w.Write(out)
+	return err
+}
+
+func chunk(dst []byte, id string, content []byte) []byte {
+	dst = append(dst, id...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(content)))
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	return append(dst, content...)
+}
+
+// DefaultPalette gives the first materials distinct colours and greys out
+// the rest.
+func DefaultPalette() []color.RGBA {
+	palette := []color.RGBA{
+		{139, 90, 43, 255},
+		{60, 160, 60, 255},
+		{110, 80, 50, 255},
+		{230, 200, 60, 255},
+		{200, 60, 60, 255},
+		{60, 90, 200, 255},
+	}
+	for len(palette) < 256 {
+		grey := uint8(40 + len(palette)%200)
+		palette = append(palette, color.RGBA{grey, grey, grey, 255})
+	}
+	return palette
+}
+
+type jsonVoxel struct {
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Z     int    `json:"z"`
+	Token string `json:"token"`
+}
+
+// WriteJSON writes the occupied cells as a JSON array of {x, y, z, token}.
+func WriteJSON(w io.Writer, g *Grid) error {
+	voxels := g.Voxels()
+	out := make([]jsonVoxel, len(voxels))
+	for i, v := range voxels {
+		out[i] = jsonVoxel{X: v.X, Y: v.Y, Z: v.Z, Token: string(v.Token)}
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// WriteCSV writes the occupied cells as x,y,z,token rows with a header.
+func WriteCSV(w io.Writer, g *Grid) error {
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+	if err := cw.Write([]string{"x", "y", "z", "token"}); err != nil {
+		return err
+	}
+	for _, v := range g.Voxels() {
+		if err := cw.Write([]string{strconv.Itoa(v.X), strconv.Itoa(v.Y), strconv.Itoa(v.Z), string(v.Token)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,153 @@
+// Package voxel walks the tokens of an LSystem on an integer grid, treating
+// some tokens as unit moves and others as blocks placed at the current cell,
+// and exports the occupied cells.
+package voxel
+
+import (
+	"github.com/viktordanov/lsystem"
+	"sort"
+)
+
+type Point struct {
+	X, Y, Z int
+}
+
+func (p Point) Add(q Point) Point {
+	return Point{p.X + q.X, p.Y + q.Y, p.Z + q.Z}
+}
+
+type Config struct {
+	// Moves maps tokens to the step they move the turtle by.
+	Moves map[lsystem.Token]Point
+	// Blocks maps the tokens that occupy the current cell to a palette index
+	// between 1 and 255.
+	Blocks map[lsystem.Token]uint8
+	// Push and Pop save and restore the position.
+	Push, Pop lsystem.Token
+}
+
+// DefaultConfig maps the compass alphabet n, s, e and w to the y and x axes
+// and u and d to z, with F, L, D and seed (and their _ variants) as blocks.
+func DefaultConfig() Config {
+	return Config{
+		Moves: map[lsystem.Token]Point{
+			"n": {0, 1, 0},
+			"s": {0, -1, 0},
+			"e": {1, 0, 0},
+			"w": {-1, 0, 0},
+			"u": {0, 0, 1},
+			"d": {0, 0, -1},
+		},
+		Blocks: map[lsystem.Token]uint8{
+			"F":    1,
+			"F_":   1,
+			"L":    2,
+			"L_":   2,
+			"D":    3,
+			"seed": 4,
+		},
+		Push: "[",
+		Pop:  "]",
+	}
+}
+
+type Cell struct {
+	Token    lsystem.Token
+	Material uint8
+}
+
+// Grid holds the occupied cells. When several blocks land on the same cell the
+// last one wins.
+type Grid struct {
+	Cells    map[Point]Cell
+	Min, Max Point
+}
+
+type Voxel struct {
+	Point
+	Cell
+}
+
+type command struct {
+	move     Point
+	moves    bool
+	block    bool
+	material uint8
+	push     bool
+	pop      bool
+}
+
+// Build walks the current tokens of l straight from the encoded buffers.
+func Build(l *lsystem.LSystem, cfg Config) *Grid {
+	commands := make([]command, len(l.BytesToken))
+	for id, t := range l.BytesToken {
+		move, moves := cfg.Moves[t]
+		material, block := cfg.Blocks[t]
+		commands[id] = command{move: move, moves: moves, block: block, material: material, push: t == cfg.Push, pop: t == cfg.Pop}
+	}
+
+	g := &Grid{Cells: make(map[Point]Cell)}
+	var position Point
+	var stack []Point
+	l.Walk(func(t lsystem.TokenStateId, _ []float64) bool {
+		c := &commands[t.TokenId()]
+		switch {
+		case c.moves:
+			position = position.Add(c.move)
+		case c.block:
+			g.set(position, Cell{Token: l.BytesToken[t.TokenId()], Material: c.material})
+		case c.push:
+			stack = append(stack, position)
+		case c.pop && len(stack) > 0:
+			position = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+		return true
+	})
+	return g
+}
+
+func (g *Grid) set(p Point, c Cell) {
+	if len(g.Cells) == 0 {
+		g.Min, g.Max = p, p
+	}
+	g.Cells[p] = c
+	g.Min = Point{min(g.Min.X, p.X), min(g.Min.Y, p.Y), min(g.Min.Z, p.Z)}
+	g.Max = Point{max(g.Max.X, p.X), max(g.Max.Y, p.Y), max(g.Max.Z, p.Z)}
+}
+
+// Size returns the extent of the occupied cells along each axis.
+func (g *Grid) Size() Point {
+	if len(g.Cells) == 0 {
+		return Point{}
+	}
+	return Point{g.Max.X - g.Min.X + 1, g.Max.Y - g.Min.Y + 1, g.Max.Z - g.Min.Z + 1}
+}
+
+// Voxels returns the occupied cells ordered by z, y and x.
+func (g *Grid) Voxels() []Voxel {
+	voxels := make([]Voxel, 0, len(g.Cells))
+	for p, c := range g.Cells {
+		voxels = append(voxels, Voxel{Point: p, Cell: c})
+	}
+	sort.Slice(voxels, func(i, j int) bool {
+		a, b := voxels[i].Point, voxels[j].Point
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.Y != b.Y {
+			return a.Y < b.Y
+		}
+		return a.X < b.X
+	})
+	return voxels
+}
+
+// ByToken groups the occupied cells by the token that placed them.
+func (g *Grid) ByToken() map[lsystem.Token][]Point {
+	cells := make(map[lsystem.Token][]Point)
+	for _, v := range g.Voxels() {
+		cells[v.Token] = append(cells[v.Token], v.Point)
+	}
+	return cells
+}
@@ -0,0 +1,43 @@
+package voxel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/viktordanov/lsystem"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	vars, consts, rules := lsystem.ParseRules(map[lsystem.Token]string{
+		"Seed": `1 L u [ n F ] [ w F ] u e seed`,
+	})
+	ls := lsystem.NewLSystem("Seed", rules, vars, consts, false)
+	ls.IterateOnce()
+
+	g := Build(ls, DefaultConfig())
+	assert.Equal(t, map[lsystem.Token][]Point{
+		"L":    {{0, 0, 0}},
+		"F":    {{-1, 0, 1}, {0, 1, 1}},
+		"seed": {{1, 0, 2}},
+	}, g.ByToken())
+	assert.Equal(t, Point{3, 2, 3}, g.Size())
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteCSV(&buf, g))
+	assert.Equal(t, "x,y,z,token\n0,0,0,L\n-1,0,1,F\n0,1,1,F\n1,0,2,seed\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, WriteJSON(&buf, g))
+	assert.Equal(t, `[{"x":0,"y":0,"z":0,"token":"L"},{"x":-1,"y":0,"z":1,"token":"F"},{"x":0,"y":1,"z":1,"token":"F"},{"x":1,"y":0,"z":2,"token":"seed"}]`+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, WriteVOX(&buf, g, nil))
+	vox := buf.Bytes()
+	assert.Equal(t, "VOX ", string(vox[:4]))
+	assert.Equal(t, "SIZE", string(vox[20:24]))
+	assert.Equal(t, "XYZI", string(vox[44:48]))
+	assert.Equal(t, uint32(4), binary.LittleEndian.Uint32(vox[56:]))
+	assert.Equal(t, []byte{1, 0, 0, 2}, vox[60:64])
+	assert.Len(t, vox, 20+3*12+12+4+16+1024)
+}